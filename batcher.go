@@ -0,0 +1,88 @@
+package dataloader
+
+import "sync"
+
+// Batcher collects the pending keys of several loaders sharing a backend, e.g. users by
+// ID and users by email, so that their batches are dispatched together, by a single
+// fetch of the scheduler. Each loader keeps its own cache and batchLoader, see
+// WithBatcher.
+//
+// Before the loaders fetch, the Batcher hands all their pending keys to onDispatch,
+// which may coalesce them into a single backend call and Prime the loaders with the
+// values: the loaders then only fetch the keys left uncached.
+type Batcher struct {
+	onDispatch func(pending []PendingKeys)
+
+	mu      sync.Mutex
+	pending []pendingLoader // The batches of the fetch scheduled, if any.
+}
+
+// PendingKeys are the keys of a loader about to be fetched, in no particular order,
+// see Batcher.
+type PendingKeys struct {
+	Loader *DataLoader
+	Keys   []interface{}
+}
+
+type pendingLoader struct {
+	dl *DataLoader
+	b  *batch
+}
+
+// NewBatcher creates a Batcher calling onDispatch, if not nil, before each fetch.
+func NewBatcher(onDispatch func(pending []PendingKeys)) *Batcher {
+	return &Batcher{onDispatch: onDispatch}
+}
+
+// add makes the Batcher fetch b, scheduling the fetch with low priority if b is the
+// first batch of the cycle.
+//
+// Must be called with dl.mu locked.
+func (bt *Batcher) add(dl *DataLoader, b *batch) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if len(bt.pending) == 0 {
+		dl.sch.SpawnLow(bt.fetch)
+	}
+	bt.pending = append(bt.pending, pendingLoader{dl, b})
+}
+
+// fetch hands the keys of the pending batches not cached to onDispatch, then fetches the
+// batches one after the other.
+func (bt *Batcher) fetch() {
+	bt.mu.Lock()
+	pending := bt.pending
+	bt.pending = nil
+	bt.mu.Unlock()
+	if bt.onDispatch != nil {
+		var all []PendingKeys
+		for _, p := range pending {
+			if keys := p.dl.uncached(p.b); len(keys) > 0 {
+				all = append(all, PendingKeys{Loader: p.dl, Keys: keys})
+			}
+		}
+		if len(all) > 0 {
+			bt.onDispatch(all)
+		}
+	}
+	for _, p := range pending {
+		p.dl.fetch(p.b)
+	}
+}
+
+// uncached returns the keys of b not cached, unless b was dispatched already, e.g. by
+// Flush.
+func (dl *DataLoader) uncached(b *batch) []interface{} {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	if b.dispatched {
+		return nil
+	}
+	var keys []interface{}
+	for mkey, key := range b.keys {
+		if _, ok := dl.cache.Get(mkey); !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
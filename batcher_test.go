@@ -0,0 +1,69 @@
+package dataloader_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestBatcher(t *testing.T) {
+	var fetched []string
+	fetch := func(name string) func(keys []interface{}) []dataloader.Value {
+		return func(keys []interface{}) []dataloader.Value {
+			for _, k := range keys {
+				fetched = append(fetched, fmt.Sprint(name, ":", k))
+			}
+			values := make([]dataloader.Value, len(keys))
+			for i, k := range keys {
+				values[i] = dataloader.NewValue(fmt.Sprint(name, " ", k), nil)
+			}
+			return values
+		}
+	}
+
+	var dispatched []string
+	var byID, byEmail *dataloader.DataLoader
+	bt := dataloader.NewBatcher(func(pending []dataloader.PendingKeys) {
+		var all []string
+		for _, p := range pending {
+			for _, k := range p.Keys {
+				all = append(all, fmt.Sprint(k))
+				// Coalesce the emails into the fetch by ID.
+				if p.Loader == byEmail && k == "a@x" {
+					byEmail.Prime(k, dataloader.NewValue("user 1", nil))
+				}
+			}
+		}
+		sort.Strings(all)
+		dispatched = append(dispatched, strings.Join(all, " "))
+	})
+
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		byID = dataloader.New(sch, fetch("id"), dataloader.WithBatcher(bt))
+		byEmail = dataloader.New(sch, fetch("email"), dataloader.WithBatcher(bt))
+		byID.Prime(2, dataloader.NewValue("cached", nil))
+
+		var got []interface{}
+		thunks := []func() dataloader.Value{
+			byID.LoadThunk(1),
+			byID.LoadThunk(2),
+			byEmail.LoadThunk("a@x"),
+			byEmail.LoadThunk("b@x"),
+		}
+		for _, thunk := range thunks {
+			got = append(got, thunk().V)
+		}
+		if fmt.Sprint(got) != "[id 1 cached user 1 email b@x]" {
+			t.Error("unexpected values", got)
+		}
+	})
+	if fmt.Sprint(dispatched) != "[1 a@x b@x]" {
+		t.Error("expect the keys of both loaders dispatched together, got", dispatched)
+	}
+	if fmt.Sprint(fetched) != "[id:1 email:b@x]" {
+		t.Error("expect the primed keys not fetched, got", fetched)
+	}
+}
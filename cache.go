@@ -0,0 +1,502 @@
+package dataloader
+
+import (
+	"container/list"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache stores the values loaded by a DataLoader, by map key (see MapKeyer). The default
+// is an unbounded map, see WithCache to plug another one.
+//
+// Implementations must be safe for concurrent use: the loader serializes the writes,
+// but reads happen concurrently with them.
+type Cache interface {
+	Get(key interface{}) (Value, bool)
+	Set(key interface{}, v Value)
+	Delete(key interface{})
+	// Clear removes all the values.
+	Clear()
+	// Len returns the number of values.
+	Len() int
+	// Range calls f for each value, until f returns false. f must not modify the cache.
+	Range(f func(key interface{}, v Value) bool)
+}
+
+// BatchCache is a Cache accessed in batches, e.g. a remote one where each access is a
+// round trip. The loader then never accesses it with its lock held: it reads the keys
+// of each load with a single GetMany, and writes the values of each fetch with a
+// single SetMany once they are stored. The misses aren't looked up again before being
+// fetched, so a key cached meanwhile by another loader is fetched again.
+type BatchCache interface {
+	Cache
+	// GetMany returns the values of keys, found[i] telling whether keys[i] is cached.
+	GetMany(keys []interface{}) (values []Value, found []bool)
+	// SetMany stores values[i] for keys[i].
+	SetMany(keys []interface{}, values []Value)
+}
+
+// mapCache is the default cache, a map behind a single lock.
+type mapCache struct {
+	mu       sync.RWMutex
+	m        map[interface{}]Value
+	capacity int
+}
+
+func newMapCache(capacity int) *mapCache {
+	return &mapCache{m: make(map[interface{}]Value, capacity), capacity: capacity}
+}
+
+func (c *mapCache) Get(key interface{}) (Value, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *mapCache) Set(key interface{}, v Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m[key] = v
+}
+
+func (c *mapCache) Delete(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.m, key)
+}
+
+func (c *mapCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[interface{}]Value, c.capacity)
+}
+
+func (c *mapCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.m)
+}
+
+func (c *mapCache) Range(f func(key interface{}, v Value) bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for k, v := range c.m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// noCache stores nothing, see WithoutCache.
+type noCache struct{}
+
+func (noCache) Get(key interface{}) (Value, bool)           { return Value{}, false }
+func (noCache) Set(key interface{}, v Value)                {}
+func (noCache) Delete(key interface{})                      {}
+func (noCache) Clear()                                      {}
+func (noCache) Len() int                                    { return 0 }
+func (noCache) Range(f func(key interface{}, v Value) bool) {}
+
+// shardedCache spreads the keys over several caches, each with its own lock, to reduce
+// contention between concurrent readers.
+type shardedCache struct {
+	shards []Cache
+}
+
+func newShardedCache(n int, newShard func() Cache) *shardedCache {
+	if n < 1 {
+		n = 1
+	}
+	c := &shardedCache{shards: make([]Cache, n)}
+	for i := range c.shards {
+		c.shards[i] = newShard()
+	}
+	return c
+}
+
+func (c *shardedCache) shard(key interface{}) Cache {
+	return c.shards[hashKey(key)%uint64(len(c.shards))]
+}
+
+func (c *shardedCache) Get(key interface{}) (Value, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *shardedCache) Set(key interface{}, v Value) {
+	c.shard(key).Set(key, v)
+}
+
+func (c *shardedCache) Delete(key interface{}) {
+	c.shard(key).Delete(key)
+}
+
+func (c *shardedCache) Clear() {
+	for _, s := range c.shards {
+		s.Clear()
+	}
+}
+
+func (c *shardedCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+func (c *shardedCache) Range(f func(key interface{}, v Value) bool) {
+	for _, s := range c.shards {
+		more := true
+		s.Range(func(key interface{}, v Value) bool {
+			more = f(key, v)
+			return more
+		})
+		if !more {
+			return
+		}
+	}
+}
+
+// setWithTTL sets the value in the shard of the key, see ttlCache.
+func (c *shardedCache) setWithTTL(key interface{}, v Value, ttl time.Duration) {
+	c.shard(key).(expiringCache).setWithTTL(key, v, ttl)
+}
+
+func (c *shardedCache) removeExpired() {
+	for _, s := range c.shards {
+		s.(expiringCache).removeExpired()
+	}
+}
+
+// lruCache is a cache holding at most max values, or values of a total cost of at most
+// maxCost, evicting the least recently used ones when full. A zero limit is no limit.
+type lruCache struct {
+	mu      sync.Mutex
+	max     int
+	maxCost int64
+	cost    func(v Value) int64
+	total   int64      // Cost of the values held.
+	order   *list.List // Of *lruEntry, most recently used first.
+	m       map[interface{}]*list.Element
+	// onEvict, if set, is called with the evicted values, c.mu locked.
+	onEvict func(key interface{}, v Value)
+}
+
+type lruEntry struct {
+	key  interface{}
+	v    Value
+	cost int64
+}
+
+func newLRUCache(max int) *lruCache {
+	return &lruCache{max: max, order: list.New(), m: make(map[interface{}]*list.Element)}
+}
+
+// withCost makes c hold values of a total cost of at most maxCost, as given by cost.
+func (c *lruCache) withCost(maxCost int64, cost func(v Value) int64) *lruCache {
+	c.maxCost = maxCost
+	c.cost = cost
+	return c
+}
+
+func (c *lruCache) full() bool {
+	return (c.max > 0 && c.order.Len() > c.max) || (c.maxCost > 0 && c.total > c.maxCost)
+}
+
+func (c *lruCache) Get(key interface{}) (Value, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return Value{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).v, true
+}
+
+func (c *lruCache) Set(key interface{}, v Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var cost int64
+	if c.cost != nil {
+		cost = c.cost(v)
+	}
+	if e, ok := c.m[key]; ok {
+		entry := e.Value.(*lruEntry)
+		c.total += cost - entry.cost
+		entry.v, entry.cost = v, cost
+		c.order.MoveToFront(e)
+	} else {
+		c.m[key] = c.order.PushFront(&lruEntry{key, v, cost})
+		c.total += cost
+	}
+	// A value costing more than maxCost on its own is evicted right away.
+	for c.full() {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		entry := oldest.Value.(*lruEntry)
+		delete(c.m, entry.key)
+		c.total -= entry.cost
+		if c.onEvict != nil {
+			c.onEvict(entry.key, entry.v)
+		}
+	}
+}
+
+func (c *lruCache) Delete(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[key]; ok {
+		c.order.Remove(e)
+		delete(c.m, key)
+		c.total -= e.Value.(*lruEntry).cost
+	}
+}
+
+func (c *lruCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.m = make(map[interface{}]*list.Element)
+	c.total = 0
+}
+
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *lruCache) Range(f func(key interface{}, v Value) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*lruEntry)
+		if !f(entry.key, entry.v) {
+			return
+		}
+	}
+}
+
+// FNV-1a.
+const (
+	hashOffset = 14695981039346656037
+	hashPrime  = 1099511628211
+)
+
+// hashKey hashes a comparable key, such that keys equal with == have the same hash.
+func hashKey(key interface{}) uint64 {
+	switch k := key.(type) {
+	case string:
+		return hashString(hashOffset, k)
+	case int:
+		return hashUint(hashOffset, uint64(k))
+	case int64:
+		return hashUint(hashOffset, uint64(k))
+	}
+	return hashValue(hashOffset, reflect.ValueOf(key))
+}
+
+func hashString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= hashPrime
+	}
+	return h
+}
+
+func hashUint(h uint64, u uint64) uint64 {
+	for i := 0; i < 8; i++ {
+		h ^= u & 0xff
+		h *= hashPrime
+		u >>= 8
+	}
+	return h
+}
+
+func hashValue(h uint64, v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Invalid:
+		return h
+	case reflect.String:
+		return hashString(h, v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			return hashUint(h, 1)
+		}
+		return hashUint(h, 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return hashUint(h, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return hashUint(h, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if f == 0 {
+			// +0 == -0.
+			f = 0
+		}
+		return hashUint(h, math.Float64bits(f))
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		return hashValue(hashValue(h, reflect.ValueOf(real(c))), reflect.ValueOf(imag(c)))
+	case reflect.Ptr, reflect.Chan, reflect.UnsafePointer:
+		return hashUint(h, uint64(v.Pointer()))
+	case reflect.Interface:
+		if v.IsNil() {
+			return h
+		}
+		return hashValue(h, v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			h = hashValue(h, v.Index(i))
+		}
+		return h
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			h = hashValue(h, v.Field(i))
+		}
+		return h
+	}
+	// Not comparable, it would fail as a map key anyway.
+	return h
+}
+
+// expiringCache is a cache expiring its values, a ttlCache or a shardedCache of them.
+type expiringCache interface {
+	Cache
+	// setWithTTL is Set with a ttl of its own, a zero ttl never expiring.
+	setWithTTL(key interface{}, v Value, ttl time.Duration)
+	// removeExpired removes all the expired values.
+	removeExpired()
+}
+
+// ttlCache wraps a cache to expire its values a fixed time after they are set, or
+// never with a zero ttl, unless set with setWithTTL. Expired values are removed lazily,
+// when accessed or by removeExpired.
+type ttlCache struct {
+	Cache
+	ttl time.Duration
+	now func() time.Time
+
+	// mu makes checking the expiry and removing the value atomic.
+	mu      sync.Mutex
+	expires map[interface{}]time.Time
+	// expiring is len(expires), read atomically by Get to skip the lock when no value
+	// expires, e.g. without WithTTL.
+	expiring int64
+	// onExpire, if set, is called with the expired values when removed, c.mu locked.
+	onExpire func(key interface{}, v Value)
+}
+
+func newTTLCache(c Cache, ttl time.Duration) *ttlCache {
+	return &ttlCache{Cache: c, ttl: ttl, now: time.Now, expires: make(map[interface{}]time.Time)}
+}
+
+func (c *ttlCache) Get(key interface{}) (Value, bool) {
+	if atomic.LoadInt64(&c.expiring) == 0 {
+		return c.Cache.Get(key)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exp, ok := c.expires[key]; ok && !c.now().Before(exp) {
+		c.removeLocked(key)
+		return Value{}, false
+	}
+	return c.Cache.Get(key)
+}
+
+func (c *ttlCache) Set(key interface{}, v Value) {
+	c.setWithTTL(key, v, c.ttl)
+}
+
+// setWithTTL is Set with a ttl of its own, a zero ttl never expiring.
+func (c *ttlCache) setWithTTL(key interface{}, v Value, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl != 0 {
+		c.expires[key] = c.now().Add(ttl)
+		c.countLocked()
+	} else {
+		c.evictedLocked(key)
+	}
+	c.Cache.Set(key, v)
+}
+
+// countLocked updates expiring.
+//
+// Must be called with c.mu locked.
+func (c *ttlCache) countLocked() {
+	atomic.StoreInt64(&c.expiring, int64(len(c.expires)))
+}
+
+// evictedLocked drops the expiry of a value evicted by the wrapped cache, which only
+// evicts when a value is set, i.e. from setWithTTL.
+//
+// Must be called with c.mu locked.
+func (c *ttlCache) evictedLocked(key interface{}) {
+	delete(c.expires, key)
+	c.countLocked()
+}
+
+func (c *ttlCache) Delete(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictedLocked(key)
+	c.Cache.Delete(key)
+}
+
+func (c *ttlCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expires = make(map[interface{}]time.Time)
+	c.countLocked()
+	c.Cache.Clear()
+}
+
+// Range skips the expired values. Len still counts them until they are removed.
+func (c *ttlCache) Range(f func(key interface{}, v Value) bool) {
+	now := c.now()
+	c.mu.Lock()
+	expired := make(map[interface{}]bool)
+	for key, exp := range c.expires {
+		if !now.Before(exp) {
+			expired[key] = true
+		}
+	}
+	c.mu.Unlock()
+	c.Cache.Range(func(key interface{}, v Value) bool {
+		if expired[key] {
+			return true
+		}
+		return f(key, v)
+	})
+}
+
+// removeExpired removes all the expired values.
+func (c *ttlCache) removeExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for key, exp := range c.expires {
+		if !now.Before(exp) {
+			c.removeLocked(key)
+		}
+	}
+}
+
+// removeLocked removes an expired value.
+//
+// Must be called with c.mu locked.
+func (c *ttlCache) removeLocked(key interface{}) {
+	if c.onExpire != nil {
+		if v, ok := c.Cache.Get(key); ok {
+			c.onExpire(key, v)
+		}
+	}
+	c.evictedLocked(key)
+	c.Cache.Delete(key)
+}
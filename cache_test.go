@@ -0,0 +1,566 @@
+package dataloader_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+)
+
+type compositeKey struct {
+	tenant string
+	id     int
+	ptr    *int
+	iface  interface{}
+}
+
+func TestShardedCache(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(fmt.Sprint(key), nil)
+		}
+		return values
+	}, dataloader.WithShardedCache(8))
+
+	one := 1
+	keys := []interface{}{
+		"a", 1, int64(1), 2.5, -0.0, true, [2]int{1, 2},
+		compositeKey{"t", 1, &one, "x"},
+	}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, i+1000)
+	}
+	dl.LoadMany(keys)
+	// Equal keys, built separately, must map to the same shard.
+	again := []interface{}{
+		"a", 1, int64(1), 2.5, 0.0, true, [2]int{1, 2},
+		compositeKey{"t", 1, &one, "x"},
+	}
+	for i, v := range dl.LoadMany(again) {
+		if v.V != fmt.Sprint(keys[i]) {
+			t.Errorf("unexpected value for %v: %v", again[i], v)
+		}
+	}
+	if len(fetched) != len(keys) {
+		t.Error("expect the second load to hit the cache, fetched:", len(fetched))
+	}
+
+	dl.ClearAll()
+	dl.LoadMany(again)
+	if len(fetched) != len(keys)+len(again) {
+		t.Error("expect ClearAll to clear all shards, fetched:", len(fetched))
+	}
+}
+
+func benchmarkConcurrentReads(b *testing.B, opts ...dataloader.Option) {
+	dl := dataloader.New(nil, dataloader.Serial(func(key interface{}) dataloader.Value {
+		return dataloader.NewValue(key, nil)
+	}), opts...)
+	keys := make([]interface{}, 1024)
+	for i := range keys {
+		keys[i] = i
+	}
+	dl.LoadMany(keys)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			dl.Load(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+func BenchmarkConcurrentReadsSingleLock(b *testing.B) {
+	benchmarkConcurrentReads(b)
+}
+
+func BenchmarkConcurrentReadsSharded(b *testing.B) {
+	benchmarkConcurrentReads(b, dataloader.WithShardedCache(16))
+}
+
+func BenchmarkConcurrentReadsShardedTTL(b *testing.B) {
+	benchmarkConcurrentReads(b, dataloader.WithShardedCache(16), dataloader.WithTTL(time.Hour))
+}
+
+func TestTTL(t *testing.T) {
+	var calls int
+	var got []interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			calls++
+			values := make([]dataloader.Value, len(keys))
+			for i := range keys {
+				values[i] = dataloader.NewValue(calls, nil)
+			}
+			return values
+		}, dataloader.WithTTL(20*time.Millisecond))
+
+		dl.Load("a")
+		if v := dl.Load("a").V; v != 1 {
+			t.Error("expect a cache hit before expiry, got", v)
+		}
+		time.Sleep(30 * time.Millisecond)
+
+		wg := dataloader.NewWaitGroup(sch)
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			sch.Spawn(func() {
+				defer wg.Done()
+				got = append(got, dl.Load("a").V)
+			})
+		}
+		wg.Wait()
+		dl.RemoveExpired()
+		if v := dl.Load("a").V; v != 2 {
+			t.Error("expect the fetched value to be cached again, got", v)
+		}
+	})
+	if fmt.Sprint(got) != "[2 2 2]" || calls != 2 {
+		t.Errorf("expect concurrent loads of the expired key to share a fetch, got %v after %d calls", got, calls)
+	}
+}
+
+func TestTTLWithMaxSize(t *testing.T) {
+	for _, opts := range [][]dataloader.Option{
+		{dataloader.WithMaxSize(10)},
+		{dataloader.WithMaxCost(10, func(v dataloader.Value) int64 { return 1 })},
+		{dataloader.WithMaxSize(10), dataloader.WithShardedCache(2)},
+	} {
+		opts = append(opts, dataloader.WithTTL(time.Hour))
+		dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+			return make([]dataloader.Value, len(keys))
+		}, opts...)
+		for i := 0; i < 1000; i++ {
+			dl.Load(i)
+		}
+		if n := dataloader.TTLEntries(dl); n != dl.Len() || n > 10 {
+			t.Errorf("expect the expiries of the evicted values dropped, got %d for %d values", n, dl.Len())
+		}
+	}
+}
+
+func TestPrimeWithTTL(t *testing.T) {
+	var fetched []interface{}
+	for _, opts := range [][]dataloader.Option{
+		{dataloader.WithTTL(20 * time.Millisecond)},
+		{dataloader.WithTTL(20 * time.Millisecond), dataloader.WithShardedCache(4)},
+	} {
+		fetched = nil
+		dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+			fetched = append(fetched, keys...)
+			return make([]dataloader.Value, len(keys))
+		}, opts...)
+
+		dl.PrimeWithTTL("forever", dataloader.NewValue(1, nil), 0)
+		dl.PrimeWithTTL("long", dataloader.NewValue(1, nil), time.Hour)
+		dl.PrimeWithTTL("short", dataloader.NewValue(1, nil), time.Millisecond)
+		time.Sleep(5 * time.Millisecond)
+		dl.Load("short")
+		if fmt.Sprint(fetched) != "[short]" {
+			t.Error("expect the value primed with a shorter TTL to expire, fetched:", fetched)
+		}
+		time.Sleep(30 * time.Millisecond)
+		fetched = nil
+		dl.Load("forever")
+		dl.Load("long")
+		dl.Load("short")
+		if fmt.Sprint(fetched) != "[short]" {
+			t.Error("expect the values primed with longer TTLs to stay cached, fetched:", fetched)
+		}
+		dl.RemoveExpired()
+		if n := dataloader.TTLEntries(dl); n != 2 {
+			t.Error("expect the expiries of long and short left, got", n)
+		}
+	}
+
+	// Without WithTTL, only the values primed with a TTL expire.
+	fetched = nil
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.PrimeWithTTL("short", dataloader.NewValue(1, nil), time.Millisecond)
+	dl.Prime("primed", dataloader.NewValue(1, nil))
+	dl.Load("fetched")
+	time.Sleep(5 * time.Millisecond)
+	dl.LoadMany([]interface{}{"short", "primed", "fetched"})
+	if fmt.Sprint(fetched) != "[fetched short]" {
+		t.Error("expect only the value primed with a TTL to expire, fetched:", fetched)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithMaxSize(2))
+
+	dl.Load("a")
+	dl.Load("b")
+	dl.Load("a") // b is now the least recently used.
+	dl.Load("c") // Evicts b.
+	fetched = nil
+	dl.Load("a")
+	dl.Load("c")
+	if len(fetched) != 0 {
+		t.Error("expect recently used keys to stay cached, fetched:", fetched)
+	}
+	dl.Load("b")
+	if fmt.Sprint(fetched) != "[b]" {
+		t.Error("expect the least recently used key to be evicted, fetched:", fetched)
+	}
+
+	// A batch larger than the cache still delivers all its values.
+	values := dl.LoadMany([]interface{}{"x", "y", "z"})
+	if len(values) != 3 {
+		t.Error("unexpected values:", values)
+	}
+}
+
+func TestMaxCost(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, k := range keys {
+			values[i] = dataloader.NewValue(k, nil)
+		}
+		return values
+	}, dataloader.WithMaxCost(10, func(v dataloader.Value) int64 {
+		return int64(len(v.V.(string)))
+	}))
+
+	dl.Load("aaaa")
+	dl.Load("bbbbbb")
+	dl.Load("cc") // Evicts aaaa, the total cost being 12.
+	fetched = nil
+	dl.Load("bbbbbb")
+	dl.Load("cc")
+	if len(fetched) != 0 {
+		t.Error("expect the keys within budget to stay cached, fetched:", fetched)
+	}
+	dl.Load("aaaa") // Evicts bbbbbb.
+	if fmt.Sprint(fetched) != "[aaaa]" {
+		t.Error("expect the least recently used key to be evicted, fetched:", fetched)
+	}
+
+	// The cost of cleared values is given back.
+	dl.Clear("aaaa")
+	dl.Load("dddddddd")
+	fetched = nil
+	dl.Load("cc")
+	if len(fetched) != 0 {
+		t.Error("expect cc to stay cached, fetched:", fetched)
+	}
+
+	// A value over budget on its own isn't kept.
+	fetched = nil
+	huge := "xxxxxxxxxxx"
+	if v := dl.Load(huge); v.V != huge {
+		t.Error("expect the value delivered regardless, got", v)
+	}
+	dl.Load(huge)
+	if len(fetched) != 2 {
+		t.Error("expect the value over budget fetched again, fetched:", fetched)
+	}
+}
+
+// recordingCache is a Cache logging the writes.
+type recordingCache struct {
+	sync.Mutex
+	m   map[interface{}]dataloader.Value
+	log []string
+}
+
+func (c *recordingCache) Get(key interface{}) (dataloader.Value, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.m[key]
+	return v, ok
+}
+
+func (c *recordingCache) Set(key interface{}, v dataloader.Value) {
+	c.Lock()
+	defer c.Unlock()
+	c.log = append(c.log, fmt.Sprint("set ", key))
+	c.m[key] = v
+}
+
+func (c *recordingCache) Delete(key interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.log = append(c.log, fmt.Sprint("delete ", key))
+	delete(c.m, key)
+}
+
+func (c *recordingCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.log = append(c.log, "clear")
+	c.m = make(map[interface{}]dataloader.Value)
+}
+
+func (c *recordingCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.m)
+}
+
+func (c *recordingCache) Range(f func(key interface{}, v dataloader.Value) bool) {
+	c.Lock()
+	defer c.Unlock()
+	for k, v := range c.m {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+func TestWithCache(t *testing.T) {
+	c := &recordingCache{m: make(map[interface{}]dataloader.Value)}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithCache(c))
+	dl.Load("a")
+	dl.Prime("b", dataloader.Value{})
+	dl.Clear("a")
+	dl.ClearAll()
+	if fmt.Sprint(c.log) != "[set a set b delete a clear]" {
+		t.Error("expect the loader to go through the cache, got:", c.log)
+	}
+}
+
+// batchRecordingCache is a BatchCache logging the writes and the batched reads, and
+// failing the test when accessed with the loader locked.
+type batchRecordingCache struct {
+	*recordingCache
+	t  *testing.T
+	dl *dataloader.DataLoader
+}
+
+func (c *batchRecordingCache) check() {
+	if c.dl != nil && dataloader.Locked(c.dl) {
+		c.t.Error("expect the cache not to be accessed with the loader locked")
+	}
+}
+
+func (c *batchRecordingCache) Get(key interface{}) (dataloader.Value, bool) {
+	c.check()
+	return c.recordingCache.Get(key)
+}
+
+func (c *batchRecordingCache) Set(key interface{}, v dataloader.Value) {
+	c.check()
+	c.recordingCache.Set(key, v)
+}
+
+func (c *batchRecordingCache) Delete(key interface{}) {
+	c.check()
+	c.recordingCache.Delete(key)
+}
+
+func (c *batchRecordingCache) Clear() {
+	c.check()
+	c.recordingCache.Clear()
+}
+
+func (c *batchRecordingCache) Range(f func(key interface{}, v dataloader.Value) bool) {
+	c.check()
+	c.recordingCache.Range(f)
+}
+
+func (c *batchRecordingCache) GetMany(keys []interface{}) ([]dataloader.Value, []bool) {
+	c.check()
+	c.Lock()
+	defer c.Unlock()
+	c.log = append(c.log, fmt.Sprint("get ", keys))
+	values := make([]dataloader.Value, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		values[i], found[i] = c.m[key]
+	}
+	return values, found
+}
+
+func (c *batchRecordingCache) SetMany(keys []interface{}, values []dataloader.Value) {
+	c.check()
+	c.Lock()
+	defer c.Unlock()
+	c.log = append(c.log, fmt.Sprint("set ", keys))
+	for i, key := range keys {
+		c.m[key] = values[i]
+	}
+}
+
+func TestWithBatchCache(t *testing.T) {
+	c := &batchRecordingCache{recordingCache: &recordingCache{m: make(map[interface{}]dataloader.Value)}, t: t}
+	var fetched []interface{}
+	var dl *dataloader.DataLoader
+	dl = dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			if key == "primed while fetched" {
+				dl.Prime(key, dataloader.NewValue("primed", nil))
+			}
+			values[i] = dataloader.NewValue("fetched", nil)
+		}
+		return values
+	}, dataloader.WithCache(c))
+	c.dl = dl
+
+	dl.LoadMany([]interface{}{"a", "a"})
+	dl.LoadMany([]interface{}{"a", "b"})
+	dl.Prime("a", dataloader.NewValue("primed", nil))
+	dl.Prime("c", dataloader.NewValue("primed", nil))
+	dl.Clear("b")
+	values := dl.LoadMany([]interface{}{"a", "b", "c"})
+	if fmt.Sprint(fetched) != "[a b b]" || values[0].V != "fetched" || values[2].V != "primed" {
+		t.Error("expect the loader to go through the cache, fetched:", fetched, "got:", values)
+	}
+	if v := dl.Load("primed while fetched"); v.V != "primed" {
+		t.Error("expect the value primed while fetched to be kept, got:", v)
+	}
+	dl.ClearAll()
+	want := "[get [a a] set [a] get [a b] set [b] get [a] get [c] set [c] delete b get [a b c] set [b] " +
+		"get [primed while fetched] get [primed while fetched] set [primed while fetched] set [primed while fetched] clear]"
+	if fmt.Sprint(c.log) != want {
+		t.Error("expect a single access to the cache by load and fetch, got:", c.log)
+	}
+}
+
+func TestWithoutCache(t *testing.T) {
+	var batches [][]interface{}
+	var values []dataloader.Value
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, keys)
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(key, nil)
+			}
+			return values
+		}, dataloader.WithoutCache())
+		for i := 0; i < 3; i++ {
+			sch.Spawn(func() {
+				values = append(values, dl.Load("a"))
+			})
+		}
+		sch.SpawnLow(func() {
+			values = append(values, dl.Load("a"))
+		})
+	})
+	if fmt.Sprint(batches) != "[[a] [a]]" {
+		t.Error("expect concurrent loads to share a fetch, and later ones to fetch again, got:", batches)
+	}
+	if fmt.Sprint(values) != "[{a <nil>} {a <nil>} {a <nil>} {a <nil>}]" {
+		t.Error("unexpected values:", values)
+	}
+}
+
+func TestLen(t *testing.T) {
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithMaxSize(3))
+	if dl.Len() != 0 {
+		t.Error("expect an empty cache, got", dl.Len())
+	}
+	dl.LoadMany([]interface{}{"a", "b"})
+	if dl.Len() != 2 {
+		t.Error("expect 2 values, got", dl.Len())
+	}
+	dl.LoadMany([]interface{}{"c", "d", "e"})
+	if dl.Len() != 3 {
+		t.Error("expect the cache to stay bounded, got", dl.Len())
+	}
+	dl.ClearAll()
+	if dl.Len() != 0 {
+		t.Error("expect an empty cache after ClearAll, got", dl.Len())
+	}
+}
+
+func TestHas(t *testing.T) {
+	var fetches int
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetches++
+		return make([]dataloader.Value, len(keys))
+	})
+	if dl.Has(userKey{id: 1}) {
+		t.Error("expect nothing cached")
+	}
+	dl.Load(userKey{id: 1, name: "a"})
+	if !dl.Has(userKey{id: 1, name: "b"}) || dl.Has(userKey{id: 2}) {
+		t.Error("expect only the loaded key to be cached, by map key")
+	}
+	if fetches != 1 {
+		t.Error("expect Has not to load, got fetches:", fetches)
+	}
+}
+
+func TestRange(t *testing.T) {
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(key.(userKey).name, nil)
+		}
+		return values
+	})
+	dl.LoadMany([]interface{}{userKey{1, "a"}, userKey{2, "b"}, userKey{3, "c"}})
+	entries := map[interface{}]interface{}{}
+	dl.Range(func(key interface{}, v dataloader.Value) bool {
+		entries[key] = v.V
+		return true
+	})
+	if fmt.Sprint(entries) != "map[1:a 2:b 3:c]" {
+		t.Error("expect the cached values by map key, got", entries)
+	}
+	n := 0
+	dl.Range(func(key interface{}, v dataloader.Value) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Error("expect Range to stop, got calls:", n)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	var fetched []interface{}
+	newLoader := func() *dataloader.DataLoader {
+		return dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+			fetched = append(fetched, keys...)
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(fmt.Sprint("fetched ", key), nil)
+			}
+			return values
+		})
+	}
+	dl := newLoader()
+	dl.LoadMany([]interface{}{"a", "b"})
+	snapshot := dl.Snapshot()
+	dl.Clear("a")
+	if len(snapshot) != 2 {
+		t.Error("expect the snapshot to be a copy, got", snapshot)
+	}
+
+	restored := newLoader()
+	restored.Prime("a", dataloader.NewValue("primed a", nil))
+	restored.Restore(snapshot)
+	fetched = nil
+	values := restored.LoadMany([]interface{}{"a", "b"})
+	if fmt.Sprint(values) != "[{primed a <nil>} {fetched b <nil>}]" || len(fetched) != 0 {
+		t.Errorf("expect the restored values, without overriding, got %v, fetched: %v", values, fetched)
+	}
+	restored.RestoreForce(snapshot)
+	if v := restored.Load("a"); v.V != "fetched a" {
+		t.Error("expect RestoreForce to override, got", v)
+	}
+}
@@ -0,0 +1,131 @@
+package dataloader
+
+import (
+	"context"
+	"sync"
+)
+
+// Chan is like a Go channel for the tasks of a Scheduler: a task blocked in Send or
+// Recv yields, like with Notification.Wait, instead of blocking the scheduler.
+type Chan[T any] struct {
+	sch  *Scheduler
+	size int
+
+	mu     sync.Mutex
+	buf    []T
+	closed bool
+	// pushed and popped count the values sent and received, for the senders of an
+	// unbuffered channel to wait for their value to be received.
+	pushed, popped uint64
+	// changed is notified, and replaced, whenever the state above changes.
+	changed *Notification
+}
+
+// NewChan creates a channel buffering up to size values. With size 0, Send waits for
+// the value to be received.
+func NewChan[T any](sch *Scheduler, size int) *Chan[T] {
+	return &Chan[T]{sch: sch, size: size, changed: NewNotification(sch)}
+}
+
+// Send sends v, waiting for room in the buffer, or for a receiver if unbuffered. It
+// panics if the channel is closed. It gives up, dropping v, if the scheduler context is
+// done.
+func (c *Chan[T]) Send(v T) {
+	// An unbuffered channel still holds the value being handed over.
+	room := c.size
+	if room == 0 {
+		room = 1
+	}
+	c.mu.Lock()
+	for len(c.buf) >= room {
+		if !c.waitLocked() {
+			return
+		}
+	}
+	if c.closed {
+		c.mu.Unlock()
+		panic("dataloader: send on closed channel")
+	}
+	c.buf = append(c.buf, v)
+	c.pushed++
+	seq := c.pushed
+	c.notifyLocked()
+	if c.size == 0 {
+		for c.popped < seq {
+			if !c.waitLocked() {
+				return
+			}
+		}
+	}
+	c.mu.Unlock()
+}
+
+// Recv receives a value, waiting for one to be sent. ok is false if the channel is
+// closed and drained, or if the scheduler context is done.
+func (c *Chan[T]) Recv() (v T, ok bool) {
+	c.mu.Lock()
+	for {
+		if v, ok := c.tryRecvLocked(); ok {
+			c.mu.Unlock()
+			return v, true
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return v, false
+		}
+		if !c.waitLocked() {
+			return v, false
+		}
+	}
+}
+
+// Close closes the channel: Recv drains the values sent before, then returns false.
+func (c *Chan[T]) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		panic("dataloader: close of closed channel")
+	}
+	c.closed = true
+	c.notifyLocked()
+}
+
+// Len returns the number of values buffered.
+func (c *Chan[T]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.buf)
+}
+
+// Must be called with c.mu locked.
+func (c *Chan[T]) tryRecvLocked() (v T, ok bool) {
+	if len(c.buf) == 0 {
+		return v, false
+	}
+	v = c.buf[0]
+	var zero T
+	c.buf[0] = zero
+	c.buf = c.buf[1:]
+	c.popped++
+	c.notifyLocked()
+	return v, true
+}
+
+// waitLocked waits for the next change, unlocking c.mu meanwhile. It returns false,
+// with c.mu unlocked, if the scheduler context is done.
+func (c *Chan[T]) waitLocked() bool {
+	changed := c.changed
+	c.mu.Unlock()
+	if err := changed.wait(context.Background()); err != nil {
+		return false
+	}
+	c.mu.Lock()
+	return true
+}
+
+// Must be called with c.mu locked.
+func (c *Chan[T]) notifyLocked() {
+	changed := c.changed
+	c.changed = NewNotification(c.sch)
+	changed.Notify()
+}
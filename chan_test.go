@@ -0,0 +1,68 @@
+package dataloader_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestChan(t *testing.T) {
+	for _, size := range []int{0, 2} {
+		var log []string
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			c := dataloader.NewChan[int](sch, size)
+			sch.Spawn(func() {
+				for {
+					v, ok := c.Recv()
+					if !ok {
+						log = append(log, "closed")
+						return
+					}
+					log = append(log, fmt.Sprint("recv ", v))
+				}
+			})
+			sch.Spawn(func() {
+				for i := 0; i < 3; i++ {
+					c.Send(i)
+					log = append(log, fmt.Sprint("sent ", i))
+				}
+				c.Close()
+			})
+		})
+		want := map[int]string{
+			0: "[recv 0 sent 0 recv 1 sent 1 recv 2 sent 2 closed]",
+			2: "[sent 0 sent 1 recv 0 recv 1 sent 2 recv 2 closed]",
+		}[size]
+		if fmt.Sprint(log) != want {
+			t.Errorf("size %d: expect %s, got %v", size, want, log)
+		}
+	}
+}
+
+func TestChanParallel(t *testing.T) {
+	var sum int
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		c := dataloader.NewChan[int](sch, 1)
+		wg := dataloader.NewWaitGroup(sch)
+		for p := 0; p < 4; p++ {
+			wg.Add(1)
+			sch.Spawn(func() {
+				defer wg.Done()
+				for i := 1; i <= 100; i++ {
+					c.Send(i)
+				}
+			})
+		}
+		sch.Spawn(func() {
+			wg.Wait()
+			c.Close()
+		})
+		for v, ok := c.Recv(); ok; v, ok = c.Recv() {
+			sum += v
+		}
+	}, dataloader.WithSlots(4))
+	if sum != 4*5050 {
+		t.Error("expect all the values to be received, got sum", sum)
+	}
+}
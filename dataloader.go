@@ -1,53 +1,428 @@
 package dataloader
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // DataLoader is threadsafe map for loading data, and handles batching/dedupping.
-// It never expires. It is inspired by github.com/facebook/dataloader.
+// By default it never expires, see WithTTL. It is inspired by github.com/facebook/dataloader.
 type DataLoader struct {
-	mu        sync.RWMutex
-	cache     map[interface{}]Value
-	pending   map[interface{}]interface{}
-	fetchDone *Notification
+	// stats is updated atomically. It comes first, to be 64-bit aligned.
+	stats Stats
+	// gen is incremented by ClearAll and Invalidate, so that the values of fetches
+	// started before aren't cached. It is written with mu locked, and read atomically.
+	gen uint64
 
-	batchLoader func(keys []interface{}) []Value
+	mu       sync.RWMutex
+	cache    Cache
+	pending  *batch                 // Collecting keys, not fetched yet.
+	inflight map[interface{}]*batch // mkey -> batch being fetched.
+	paused   *signal                // Fired by Resume.
+
+	// batchCache is cache if it is a BatchCache, accessed without mu: its writes are
+	// queued in writes with mu locked, and done by flushWrites.
+	batchCache BatchCache
+	writes     []cacheWrite
+	writeMu    sync.Mutex // Serializes flushWrites.
+
+	prefetchQ       []prefetchKey // Waiting for the next batch, when bounded.
+	prefetchMax     int
+	prefetchPolicy  DropPolicy
+	prefetchDropped uint64
+
+	batchLoader func(ctx context.Context, keys []interface{}) []Value
 	sch         *Scheduler
+	sync        bool
+
+	cacheCap     int
+	shards       int
+	maxSize      int
+	maxCost      int64
+	cost         func(v Value) int64
+	cacheErrors  bool
+	maxBatchSize int
+	retries      int
+	retryBackoff func(attempt int) time.Duration
+	batchWindow  time.Duration
+	minBatchSize int
+	minBatchWait time.Duration
+	batchTimeout time.Duration
+	ttl          time.Duration
+	pendingCap   int
+	keyFunc      func(key interface{}) interface{}
+	eagerFetch   bool
+	onBatchStats func(s BatchStats)
+	withMeta     bool
+	perKey       bool
+	batcher      *Batcher
+	onPending    func(key interface{})
+	onFetched    func(key interface{}, v Value)
+	onEvict      func(key interface{}, v Value, reason EvictReason)
+	tracer       Tracer
+	batchHook    func(keys []interface{}, values []Value, dur time.Duration)
+
+	primePrecedence PrimePrecedence
+
+	// metas are the Meta of the cached values, with WithMeta. metaMu is a leaf lock,
+	// taken by the caches evicting values too.
+	metaMu sync.Mutex
+	metas  map[interface{}]Meta
+
+	// evictions are recorded under evictMu, to be reported outside of dl.mu.
+	evictMu   sync.Mutex
+	evictions []eviction
+
+	// id gives loaders a total order, used to lock several of them without deadlock.
+	id uint64
 }
 
+var lastLoaderID uint64
+
 // New creates a new dataloader.
-func New(sch *Scheduler, batchLoader func(keys []interface{}) []Value) *DataLoader {
-	return &DataLoader{
-		cache:       make(map[interface{}]Value),
-		pending:     make(map[interface{}]interface{}),
+//
+// With a scheduler, the loads must come from its tasks, and are batched until they all
+// wait. With a nil sch, the loader is safe for concurrent use by any goroutines, but
+// the first load waiting fetches right away, with only the keys enqueued by then: see
+// NewConcurrent to batch the loads of concurrent goroutines.
+func New(sch *Scheduler, batchLoader func(keys []interface{}) []Value, opts ...Option) *DataLoader {
+	return NewCtx(sch, func(ctx context.Context, keys []interface{}) []Value {
+		return batchLoader(keys)
+	}, opts...)
+}
+
+// NewCtx is like New, with a batchLoader taking a context, to honor the deadline and
+// the cancellation of the request: the one of the scheduler, see WithSchedulerContext,
+// with the timeout set by WithBatchTimeout if any.
+func NewCtx(sch *Scheduler, batchLoader func(ctx context.Context, keys []interface{}) []Value, opts ...Option) *DataLoader {
+	dl := &DataLoader{
 		batchLoader: batchLoader,
 		sch:         sch,
+		id:          atomic.AddUint64(&lastLoaderID, 1),
+	}
+	for _, opt := range opts {
+		opt(dl)
+	}
+	if dl.withMeta {
+		dl.metas = make(map[interface{}]Meta)
+	}
+	// Evictions are reported to WithOnEvict, and drop the Meta of the values.
+	trackEvictions := dl.onEvict != nil || dl.metas != nil
+	// Each cache, or shard, keeps the expiries of its values, see WithTTL and
+	// PrimeWithTTL, so that the shards don't share a lock. Without WithTTL, only the
+	// values primed with PrimeWithTTL expire.
+	expiring := func(c Cache) *ttlCache {
+		ttl := newTTLCache(c, dl.ttl)
+		if trackEvictions {
+			ttl.onExpire = func(key interface{}, v Value) {
+				dl.evicted(key, v, EvictExpired)
+			}
+		}
+		return ttl
 	}
+	newCache := func(capacity, max int, maxCost int64) Cache {
+		if max > 0 || maxCost > 0 {
+			c := newLRUCache(max).withCost(maxCost, dl.cost)
+			ttl := expiring(c)
+			// The expiries of the values evicted are dropped too.
+			c.onEvict = func(key interface{}, v Value) {
+				ttl.evictedLocked(key)
+				if trackEvictions {
+					dl.evicted(key, v, EvictCapacity)
+				}
+			}
+			return ttl
+		}
+		return expiring(newMapCache(capacity))
+	}
+	switch {
+	case dl.cache == Cache(noCache{}):
+		// Set by WithoutCache.
+	case dl.cache != nil:
+		// Set by WithCache. A BatchCache expires its values itself.
+		if c, ok := dl.cache.(BatchCache); ok {
+			dl.batchCache = c
+		} else {
+			dl.cache = expiring(dl.cache)
+		}
+	case dl.shards > 0:
+		dl.cache = newShardedCache(dl.shards, func() Cache {
+			n := int64(dl.shards)
+			return newCache(dl.cacheCap/dl.shards, (dl.maxSize+dl.shards-1)/dl.shards, (dl.maxCost+n-1)/n)
+		})
+	default:
+		dl.cache = newCache(dl.cacheCap, dl.maxSize, dl.maxCost)
+	}
+	dl.inflight = make(map[interface{}]*batch)
+	return dl
 }
 
-// Parallel is convenient helper to convert a single fetch to a multi-fetch that execute
-// the individual single fetch in parallel.
-func Parallel(f func(interface{}) Value) func(keys []interface{}) []Value {
+// NewWithMap creates a dataloader whose batchLoader returns the values by key rather
+// than by position, for backends returning results in arbitrary order. The map is
+// indexed by map key, i.e. by MapKey() for the keys implementing MapKeyer, or by the
+// function set by WithKeyFunc. The keys absent from the map get ErrMissingResult.
+func NewWithMap(sch *Scheduler, batchLoader func(keys []interface{}) map[interface{}]Value, opts ...Option) *DataLoader {
+	dl := New(sch, nil, opts...)
+	dl.batchLoader = dl.mapBatchLoader(batchLoader)
+	return dl
+}
+
+// mapBatchLoader adapts a batchLoader returning the values by map key to one returning
+// them by position.
+func (dl *DataLoader) mapBatchLoader(batchLoader func(keys []interface{}) map[interface{}]Value) func(ctx context.Context, keys []interface{}) []Value {
+	return func(ctx context.Context, keys []interface{}) []Value {
+		m := batchLoader(keys)
+		values := make([]Value, len(keys))
+		for i, key := range keys {
+			v, ok := m[dl.mapKey(key)]
+			if !ok {
+				v = Value{Err: ErrMissingResult}
+			}
+			values[i] = v
+		}
+		return values
+	}
+}
+
+// NewWithBatchErr creates a dataloader whose batchLoader also returns an error for the
+// whole batch, e.g. when the backend is unreachable. The error is the value of the keys
+// without one, i.e. with a zero Value or beyond the values returned: the values and
+// key errors returned along with it are kept.
+func NewWithBatchErr(sch *Scheduler, batchLoader func(keys []interface{}) ([]Value, error), opts ...Option) *DataLoader {
+	return New(sch, batchErrLoader(batchLoader), opts...)
+}
+
+// batchErrLoader adapts a batchLoader returning a batch error to one setting it to the
+// values.
+func batchErrLoader(batchLoader func(keys []interface{}) ([]Value, error)) func(keys []interface{}) []Value {
 	return func(keys []interface{}) []Value {
-		if len(keys) == 1 {
-			return []Value{f(keys[0])}
+		values, err := batchLoader(keys)
+		if err == nil {
+			return values
+		}
+		filled := make([]Value, len(keys))
+		copy(filled, values)
+		for i, v := range filled {
+			if v.V == nil && v.Err == nil {
+				filled[i].Err = err
+			}
+		}
+		return filled
+	}
+}
+
+// NewStreaming creates a dataloader whose batchLoader emits the values one by one, as
+// they are known, e.g. from a streaming backend: the loads waiting for a key are served
+// as soon as its value is emitted, rather than once the whole batch is. The keys not
+// emitted by the time the batchLoader returns get ErrMissingResult, the values emitted
+// afterwards, or again for the same key, are ignored.
+//
+// The errors emitted, other than ErrNotFound, are only served once the batchLoader
+// returns, as they may be retried, see WithRetry. With a scheduler, emit must be called
+// from the batchLoader's task; otherwise from any goroutine.
+func NewStreaming(sch *Scheduler, batchLoader func(keys []interface{}, emit func(key interface{}, v Value)), opts ...Option) *DataLoader {
+	dl := New(sch, nil, opts...)
+	dl.perKey = true
+	dl.batchLoader = func(ctx context.Context, keys []interface{}) []Value {
+		return dl.stream(ctx, keys, batchLoader)
+	}
+	return dl
+}
+
+// stream calls a batchLoader of NewStreaming, delivering the values as they are emitted.
+func (dl *DataLoader) stream(ctx context.Context, keys []interface{}, batchLoader func(keys []interface{}, emit func(key interface{}, v Value))) []Value {
+	deliver, _ := ctx.Value(deliverKey{}).(func(mkey interface{}, v Value))
+	positions := make(map[interface{}]int, len(keys))
+	for i, key := range keys {
+		positions[dl.mapKey(key)] = i
+	}
+	values := make([]Value, len(keys))
+	emitted := make([]bool, len(keys))
+	var mu sync.Mutex
+	returned := false
+	batchLoader(keys, func(key interface{}, v Value) {
+		mkey := dl.mapKey(key)
+		mu.Lock()
+		i, ok := positions[mkey]
+		if !ok || emitted[i] || returned {
+			mu.Unlock()
+			return
+		}
+		emitted[i] = true
+		values[i] = v
+		mu.Unlock()
+		if deliver != nil && settled(v) {
+			deliver(mkey, v)
 		}
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	returned = true
+	for i := range values {
+		if !emitted[i] {
+			values[i].Err = ErrMissingResult
+		}
+	}
+	return values
+}
+
+// NewConcurrent creates a dataloader without a scheduler, for loads from concurrent
+// goroutines, e.g. the handlers of a server. A batch is fetched once it has size keys,
+// or window after its first key, the loads meanwhile joining it. A size of 0 waits for
+// the window regardless. See WithMinBatchSize and WithBatchWindow, which opts can
+// still set.
+func NewConcurrent(batchLoader func(keys []interface{}) []Value, window time.Duration, size int, opts ...Option) *DataLoader {
+	batching := WithBatchWindow(window)
+	if size > 0 {
+		batching = WithMinBatchSize(size, window)
+	}
+	return New(nil, batchLoader, append([]Option{batching}, opts...)...)
+}
+
+// NewSync creates a dataloader that fetches synchronously, for programs that don't use
+// a scheduler nor load concurrently (CLI tools, batch jobs). Each LoadMany calls the
+// batchLoader right away with its own uncached keys, deduplicated, skipping all the
+// bookkeeping needed to coalesce loads from several tasks. Results are cached as usual.
+func NewSync(batchLoader func(keys []interface{}) []Value, opts ...Option) *DataLoader {
+	dl := New(nil, batchLoader, opts...)
+	dl.sync = true
+	return dl
+}
+
+// Parallel is convenient helper to convert a single fetch to a multi-fetch that execute
+// the individual single fetch in parallel, one goroutine per key. For large batches,
+// ParallelN is preferred, so as not to overwhelm the backend.
+//
+// By default a panic in a single fetch is re-raised by the multi-fetch once all the
+// other fetches have returned, see WithParallelPanicPolicy.
+func Parallel(f func(interface{}) Value, opts ...ParallelOption) func(keys []interface{}) []Value {
+	return ParallelN(0, f, opts...)
+}
+
+// ParallelN is like Parallel, but with at most n single fetches in flight, run by a
+// pool of n goroutines. n <= 0 means no limit.
+func ParallelN(n int, f func(interface{}) Value, opts ...ParallelOption) func(keys []interface{}) []Value {
+	fetch := parallel(n, func(ctx context.Context, key interface{}) Value {
+		return f(key)
+	}, opts)
+	return func(keys []interface{}) []Value {
+		return fetch(context.Background(), keys)
+	}
+}
+
+// ParallelCtx is like Parallel, for NewCtx: the context of the multi-fetch, e.g. with
+// the timeout of WithBatchTimeout, is passed to the single fetches, so that they can
+// give up once it is done. The fetches not started by then aren't, their keys get
+// ctx.Err().
+func ParallelCtx(f func(ctx context.Context, key interface{}) Value, opts ...ParallelOption) func(ctx context.Context, keys []interface{}) []Value {
+	return parallel(0, f, opts)
+}
+
+func parallel(n int, f func(context.Context, interface{}) Value, opts []ParallelOption) func(ctx context.Context, keys []interface{}) []Value {
+	var cfg parallelConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return func(ctx context.Context, keys []interface{}) []Value {
 		values := make([]Value, len(keys))
-		var wg sync.WaitGroup
-		for i := range keys {
-			wg.Add(1)
-			i := i
-			go func() {
-				defer wg.Done()
-				values[i] = f(keys[i])
+		var panicked *PanicError
+		var panicOnce sync.Once
+		fetch := func(i int) {
+			if err := ctx.Err(); err != nil {
+				values[i] = Value{Err: err}
+				return
+			}
+			defer func() {
+				r := recover()
+				if r == nil {
+					return
+				}
+				err := &PanicError{Key: keys[i], Value: r, Stack: debug.Stack()}
+				if cfg.panicPolicy == PanicRecover {
+					values[i] = Value{Err: err}
+					return
+				}
+				panicOnce.Do(func() { panicked = err })
 			}()
+			values[i] = f(ctx, keys[i])
+		}
+		if len(keys) == 1 {
+			// Without a goroutine, the panic still being wrapped.
+			fetch(0)
+		} else {
+			workers := len(keys)
+			if n > 0 && n < workers {
+				workers = n
+			}
+			// The workers take the keys in turn, next being the last taken.
+			next := int64(-1)
+			var wg sync.WaitGroup
+			wg.Add(workers)
+			for w := 0; w < workers; w++ {
+				go func() {
+					defer wg.Done()
+					for {
+						i := int(atomic.AddInt64(&next, 1))
+						if i >= len(keys) {
+							return
+						}
+						fetch(i)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+		if panicked != nil {
+			panic(panicked)
 		}
-		wg.Wait()
 		return values
 	}
 }
 
+// PanicPolicy decides what Parallel does when a single fetch panics.
+type PanicPolicy int
+
+const (
+	// PanicPropagate re-raises the panic in the goroutine running the multi-fetch, so
+	// that it can be recovered there, wrapped in a *PanicError to keep the key and the
+	// stack of the single fetch, whatever the number of keys. This is the default.
+	PanicPropagate PanicPolicy = iota
+	// PanicRecover turns the panic into a Value whose Err is a *PanicError, the other
+	// keys are unaffected.
+	PanicRecover
+)
+
+// ParallelOption configures Parallel.
+type ParallelOption func(*parallelConfig)
+
+type parallelConfig struct {
+	panicPolicy PanicPolicy
+}
+
+// WithParallelPanicPolicy sets how panics in the single fetches are handled.
+func WithParallelPanicPolicy(p PanicPolicy) ParallelOption {
+	return func(cfg *parallelConfig) {
+		cfg.panicPolicy = p
+	}
+}
+
+// PanicError records a panic recovered from a single fetch.
+type PanicError struct {
+	Key   interface{}
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("dataloader: panic while loading %v: %v", e.Key, e.Value)
+}
+
 // Serial is convenient helper to convert a single fetch to a multi-fetch that execute
 // the individual single fetch serially.
 func Serial(f func(interface{}) Value) func(keys []interface{}) []Value {
@@ -60,6 +435,48 @@ func Serial(f func(interface{}) Value) func(keys []interface{}) []Value {
 	}
 }
 
+// Fallback combines batch functions into one trying them in order, such as a local store
+// then a remote service: each one is only passed the keys the previous ones failed on,
+// the ErrNotFound and ErrMissingResult values included, and the last one has the final
+// say.
+func Fallback(sources ...func(keys []interface{}) []Value) func(keys []interface{}) []Value {
+	return func(keys []interface{}) []Value {
+		values := make([]Value, len(keys))
+		// Positions in keys of the keys left to the next source.
+		indexes := make([]int, len(keys))
+		for i := range indexes {
+			indexes[i] = i
+		}
+		for j, source := range sources {
+			if len(indexes) == 0 {
+				break
+			}
+			pending := make([]interface{}, len(indexes))
+			for i, k := range indexes {
+				pending[i] = keys[k]
+			}
+			got := source(pending)
+			last := j == len(sources)-1
+			var left []int
+			for i, k := range indexes {
+				v := Value{Err: ErrMissingResult}
+				if i < len(got) {
+					v = got[i]
+				}
+				values[k] = v
+				if v.Err != nil && !last {
+					left = append(left, k)
+				}
+			}
+			indexes = left
+		}
+		for _, k := range indexes {
+			values[k] = Value{Err: ErrMissingResult}
+		}
+		return values
+	}
+}
+
 // Value wraps the value and error.
 type Value struct {
 	V   interface{}
@@ -76,149 +493,1751 @@ func NewValue(v interface{}, err error) Value {
 	return Value{V: v, Err: err}
 }
 
-func (dl *DataLoader) scheduleFetch() *Notification {
-	// Must be called with dl.mu locked.
-	if dl.fetchDone != nil {
-		return dl.fetchDone
+var (
+	// ErrNotFound is the Err a batchLoader sets, possibly wrapped, for a key that has
+	// no record. Unlike other errors, it is a result rather than a failure: it is
+	// cached, and not retried.
+	ErrNotFound = errors.New("dataloader: not found")
+	// ErrMissingResult is the Err of the keys the batchLoader returned no value for,
+	// when it returns fewer values than keys.
+	ErrMissingResult = errors.New("dataloader: missing result")
+)
+
+// NotFound returns the value of a key with no record.
+func NotFound() Value {
+	return Value{Err: ErrNotFound}
+}
+
+// batch collects the keys to fetch together, and once fetched, their values.
+type batch struct {
+	keys       map[interface{}]interface{} // mkey -> key
+	values     map[interface{}]Value       // mkey -> value, set when done
+	fresh      map[interface{}]bool        // mkeys to fetch even if cached
+	once       map[interface{}]bool        // mkeys not to cache, see LoadOnce
+	dispatched bool
+	urgent     bool // Its fetch is scheduled with normal priority, see LoadPriority.
+	done       *signal
+	// With WithBatchWindow, the fetch waits until then to collect more keys.
+	windowEnd time.Time
+	// With WithMinBatchSize, filled is fired once the batch has minSize keys, which
+	// the fetch waits for until minDeadline. Keys resolved by Prime leave the batch,
+	// which may then reach minSize again: isFilled tells filled is fired already.
+	filled      *signal
+	isFilled    bool
+	minSize     int
+	minDeadline time.Time
+
+	// Set when dispatched, the loader's generation, and the mkeys cleared since.
+	gen     uint64
+	cleared map[interface{}]bool
+	// With a BatchCache, which isn't read with the loader's mu locked, the values
+	// primed since, taking precedence over the fetched ones, see PrimePrecedence.
+	primed map[interface{}]Value
+
+	// With WithMeta, when the fetch started, and the Meta of the values fetched.
+	started time.Time
+	meta    map[interface{}]Meta
+
+	// Counts of the keys of the loads joining the batch, see BatchStats.
+	requested, cacheHits, deduped int
+
+	// With perKey, see NewStreaming and WithPerKeyNotify, the values of some keys are
+	// set before the batch is done: delivered has them, and keyDone fires for them. The
+	// values must then be read with the loader's mu locked.
+	perKey    bool
+	delivered map[interface{}]bool
+	keyDone   map[interface{}]*signal
+}
+
+func newBatch(sch *Scheduler, capacity int) *batch {
+	return &batch{
+		keys:   make(map[interface{}]interface{}, capacity),
+		values: make(map[interface{}]Value, capacity),
+		done:   newSignal(sch),
 	}
-	if dl.sch == nil {
-		dl.mu.Unlock()
-		dl.fetchPending()
-		dl.mu.Lock()
-		return nil
+}
+
+// add adds key to the batch, unless already in, and returns whether it was added.
+func (b *batch) add(mkey, key interface{}) bool {
+	if _, ok := b.keys[mkey]; ok {
+		return false
 	}
-	n := NewNotification(dl.sch)
-	dl.fetchDone = n
-	dl.sch.SpawnLow(func() {
-		dl.fetchPending()
-		n.Notify()
-	})
-	return n
+	b.keys[mkey] = key
+	if len(b.keys) == b.minSize && !b.isFilled {
+		b.isFilled = true
+		b.filled.fire()
+	}
+	return true
 }
 
-func (dl *DataLoader) fetchPending() {
-	dl.mu.Lock()
-	defer func() {
-		dl.pending = make(map[interface{}]interface{})
-		dl.fetchDone = nil
-		dl.mu.Unlock()
-	}()
+// markOnce keeps the fetched value of mkey from being cached.
+func (b *batch) markOnce(mkey interface{}) {
+	if b.once == nil {
+		b.once = make(map[interface{}]bool)
+	}
+	b.once[mkey] = true
+}
+
+// markFresh makes the batch fetch mkey even if it is cached.
+func (b *batch) markFresh(mkey interface{}) {
+	if b.fresh == nil {
+		b.fresh = make(map[interface{}]bool)
+	}
+	b.fresh[mkey] = true
+}
 
-	keys := make([]interface{}, 0, len(dl.pending))
-	mkeys := make([]interface{}, 0, len(dl.pending))
+// signal is a one-shot event loads can wait for: a Notification when there is a
+// scheduler, a channel otherwise.
+type signal struct {
+	n  *Notification
+	ch chan struct{}
+}
 
-	for mkey, key := range dl.pending {
-		if _, ok := dl.cache[mkey]; ok {
-			continue
-		}
-		mkeys = append(mkeys, mkey)
-		keys = append(keys, key)
+func newSignal(sch *Scheduler) *signal {
+	if sch != nil {
+		return &signal{n: NewNotification(sch)}
 	}
-	if len(keys) == 0 {
-		return
+	return &signal{ch: make(chan struct{})}
+}
+
+// wait blocks until s is fired, or ctx is done, in which case it returns ctx.Err().
+func (s *signal) wait(ctx context.Context) error {
+	if s.n != nil {
+		return s.n.wait(ctx)
 	}
-	// TODO: Handle panic here?
-	// TODO: The locking can be optimized here.
-	values := dl.batchLoader(keys)
-	for i, v := range values {
-		dl.cache[mkeys[i]] = v
+	select {
+	case <-s.ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-// Load loads a single value.
-func (dl *DataLoader) Load(key interface{}) Value {
-	return dl.LoadMany([]interface{}{
-		key,
-	})[0]
+// waitEither is like wait, until either s or other is fired.
+func (s *signal) waitEither(ctx context.Context, other *signal) error {
+	if s.n != nil {
+		return s.n.sch.wait(ctx, s.n, other.n)
+	}
+	select {
+	case <-s.ch:
+		return nil
+	case <-other.ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-type MapKeyer interface {
-	MapKey() interface{}
+func (s *signal) fire() {
+	if s.n != nil {
+		s.n.Notify()
+		return
+	}
+	close(s.ch)
 }
 
-func getMapKey(key interface{}) interface{} {
-	if v, ok := key.(MapKeyer); ok {
-		return v.MapKey()
+// pendingBatch returns the batch collecting keys, creating it if needed. With a
+// scheduler, the fetch of a new batch is scheduled right away, with low priority so
+// that more keys are collected before it runs, unless WithEagerFetch, or by the Batcher
+// of WithBatcher. Without a scheduler, the loads waiting for the batch fetch it
+// themselves, see wait.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) pendingBatch() *batch {
+	if dl.pending != nil {
+		return dl.pending
 	}
-	return key
+	b := newBatch(dl.sch, dl.pendingCap)
+	b.perKey = dl.perKey
+	if dl.batchWindow > 0 {
+		b.windowEnd = time.Now().Add(dl.batchWindow)
+	}
+	if dl.minBatchSize > 0 {
+		b.filled = newSignal(dl.sch)
+		b.minSize = dl.minBatchSize
+		b.minDeadline = time.Now().Add(dl.minBatchWait)
+	}
+	dl.pending = b
+	switch {
+	case dl.sch == nil:
+	case dl.eagerFetch:
+		b.urgent = true
+		dl.sch.Spawn(func() {
+			dl.fetch(b)
+		})
+	case dl.batcher != nil:
+		dl.batcher.add(dl, b)
+	default:
+		dl.sch.SpawnLow(func() {
+			dl.fetch(b)
+		})
+	}
+	return b
 }
 
-// LoadMany loads multiple values.
-func (dl *DataLoader) LoadMany(keys []interface{}) []Value {
-	values := make([]Value, len(keys))
-	var keysToFetch []interface{}
-	var mkeysToFetch []interface{}
-	var keysToFetchIndex []int
+// fetch calls the batchLoader for the keys of b that aren't cached yet, unless b was
+// already dispatched, and wakes its waiters.
+func (dl *DataLoader) fetch(b *batch) {
+	defer dl.flushDeferred()
+	dl.mu.RLock()
+	dispatched := b.dispatched
+	dl.mu.RUnlock()
+	if dispatched {
+		// Flushed already.
+		return
+	}
+	if d := time.Until(b.windowEnd); d > 0 {
+		// The loads go on collecting keys meanwhile. The fetch goes on regardless if
+		// the scheduler is cancelled.
+		dl.sleep(d)
+	}
+	if b.filled != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), b.minDeadline)
+		b.filled.wait(ctx)
+		cancel()
+	}
+	dl.dispatch(b)
+}
 
+// dispatch fetches the keys of b, unless already dispatched, and wakes up the loads
+// waiting for them.
+func (dl *DataLoader) dispatch(b *batch) {
+	var keys []interface{}
+	var mkeys []interface{}
+	var prefetched []interface{}
+	var cancelled bool
 	func() {
-		dl.mu.RLock()
-		defer dl.mu.RUnlock()
-		for i, key := range keys {
-			mkey := getMapKey(key)
-			v, ok := dl.cache[mkey]
-			if ok {
-				values[i] = v
-				continue
-			}
-			keysToFetch = append(keysToFetch, key)
-			mkeysToFetch = append(mkeysToFetch, mkey)
-			keysToFetchIndex = append(keysToFetchIndex, i)
-		}
-	}()
-
-	if len(keysToFetch) > 0 {
-		n := func() *Notification {
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		for dl.paused != nil {
+			paused := dl.paused
+			dl.mu.Unlock()
+			err := paused.wait(context.Background())
 			dl.mu.Lock()
-			defer dl.mu.Unlock()
-			for i := 0; i < len(keysToFetch); i++ {
-				key := keysToFetch[i]
-				mkey := mkeysToFetch[i]
-				v, ok := dl.cache[mkey]
-				if ok {
-					values[keysToFetchIndex[i]] = v
-					keysToFetch[i] = keysToFetch[len(keysToFetch)-1]
-					keysToFetch = keysToFetch[:len(keysToFetch)-1]
-					keysToFetchIndex[i] = keysToFetchIndex[len(keysToFetchIndex)-1]
-					keysToFetchIndex = keysToFetchIndex[:len(keysToFetchIndex)-1]
-					continue
+			if err != nil {
+				// The scheduler was cancelled while paused, fail the loads.
+				if b.dispatched {
+					return
+				}
+				b.dispatched = true
+				if dl.pending == b {
+					dl.pending = nil
+				}
+				for mkey := range b.keys {
+					b.values[mkey] = cancelledValue(err)
 				}
-				dl.pending[mkey] = key
+				cancelled = true
+				return
 			}
-			return dl.scheduleFetch()
-		}()
-		if len(keysToFetch) > 0 {
-			if n != nil {
-				n.Wait()
+		}
+		if b.dispatched {
+			// By another load.
+			return
+		}
+		b.dispatched = true
+		b.gen = atomic.LoadUint64(&dl.gen)
+		dl.pending = nil
+		for _, k := range dl.prefetchQ {
+			b.requested++
+			if b.add(k.mkey, k.key) {
+				prefetched = append(prefetched, k.key)
+			} else {
+				b.deduped++
 			}
-			for vsi, vi := range keysToFetchIndex {
-				values[vi] = dl.cache[mkeysToFetch[vsi]]
+		}
+		dl.prefetchQ = nil
+		keys = make([]interface{}, 0, len(b.keys))
+		mkeys = make([]interface{}, 0, len(b.keys))
+		for mkey, key := range b.keys {
+			if dl.batchCache == nil {
+				if v, ok := dl.cache.Get(mkey); ok && !b.fresh[mkey] {
+					if b.once[mkey] {
+						// Consumed by LoadAndDelete.
+						dl.cache.Delete(mkey)
+					}
+					b.values[mkey] = v
+					continue
+				}
 			}
+			mkeys = append(mkeys, mkey)
+			keys = append(keys, key)
+			dl.inflight[mkey] = b
+		}
+		b.cacheHits += len(b.keys) - len(keys)
+	}()
+	if cancelled {
+		b.done.fire()
+		return
+	}
+	if keys == nil {
+		return
+	}
+	dl.notifyPending(prefetched)
+	if dl.onBatchStats != nil {
+		dl.onBatchStats(BatchStats{Requested: b.requested, CacheHits: b.cacheHits, Deduped: b.deduped, Fetched: len(keys)})
+	}
+
+	var values []Value
+	if len(keys) > 0 {
+		// The batchLoader gets the context of the span, for its calls to be children of
+		// the batch.
+		ctx, span := dl.startSpan(dl.schedulerContext(), "dataloader.batch")
+		span.SetAttribute("dataloader.batch_size", len(keys))
+		span.SetAttribute("dataloader.cache_hits", len(b.keys)-len(keys))
+		b.started = time.Now()
+		if b.perKey {
+			ctx = context.WithValue(ctx, deliverKey{}, func(mkey interface{}, v Value) {
+				dl.deliver(b, mkey, v)
+			})
 		}
+		values = dl.loadBatch(ctx, keys)
+		dl.store(b, mkeys, values)
+		// Before waking up the loads, so that the loads to come hit the cache.
+		dl.flushWrites()
+		span.End()
+	}
+	dl.notifyFetched(keys, values)
+	b.done.fire()
+}
+
+// Flush fetches the pending batch right away, in the calling goroutine or task, rather
+// than once the scheduler runs the fetch, or the loads wait, without waiting for
+// WithBatchWindow or WithMinBatchSize either. The loads from then on go to a new batch.
+// It is a no-op when no batch is pending.
+func (dl *DataLoader) Flush() {
+	dl.mu.RLock()
+	b := dl.pending
+	dl.mu.RUnlock()
+	if b == nil {
+		return
+	}
+	defer dl.flushDeferred()
+	dl.dispatch(b)
+}
+
+// schedulerContext returns the context of the scheduler, if any.
+func (dl *DataLoader) schedulerContext() context.Context {
+	if dl.sch != nil {
+		return dl.sch.Context()
 	}
+	return context.Background()
+}
+
+// loadBatch fetches the keys, retrying the failed ones if enabled by WithRetry.
+func (dl *DataLoader) loadBatch(ctx context.Context, keys []interface{}) []Value {
+	values := dl.loadChunks(ctx, keys)
+	dl.retry(ctx, keys, values)
 	return values
 }
 
-// Prime put a single value into the cache. No-op if the value already exists.
-func (dl *DataLoader) Prime(key interface{}, v Value) {
-	dl.mu.Lock()
-	defer dl.mu.Unlock()
-	if _, ok := dl.cache[key]; ok {
-		// If you want to override, call Clear first.
+// loadChunks fetches the keys, calling the batchLoader once per chunk of at most
+// maxBatchSize keys, in order.
+func (dl *DataLoader) loadChunks(ctx context.Context, keys []interface{}) []Value {
+	if dl.maxBatchSize <= 0 || len(keys) <= dl.maxBatchSize {
+		values := dl.callBatchLoader(ctx, keys)
+		dl.deliverSettled(ctx, keys, values)
+		return values
+	}
+	values := make([]Value, 0, len(keys))
+	for start := 0; start < len(keys); start += dl.maxBatchSize {
+		end := start + dl.maxBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk := dl.callBatchLoader(ctx, keys[start:end:end])
+		dl.deliverSettled(ctx, keys[start:end], chunk)
+		values = append(values, chunk...)
+	}
+	return values
+}
+
+// deliverSettled delivers the settled values of a perKey batch being fetched, so that
+// their loads don't wait for the rest of the batch.
+func (dl *DataLoader) deliverSettled(ctx context.Context, keys []interface{}, values []Value) {
+	deliver, ok := ctx.Value(deliverKey{}).(func(mkey interface{}, v Value))
+	if !ok {
 		return
 	}
-	dl.cache[key] = v
+	for i, v := range values {
+		if settled(v) {
+			deliver(dl.mapKey(keys[i]), v)
+		}
+	}
 }
 
-// Clear removes a single value from the cache.
-func (dl *DataLoader) Clear(key interface{}) {
-	dl.mu.Lock()
-	defer dl.mu.Unlock()
-	delete(dl.cache, key)
+// settled returns whether v is final, rather than an error which may be retried.
+func settled(v Value) bool {
+	return v.Err == nil || errors.Is(v.Err, ErrNotFound)
 }
 
-// ClearAll removes all values from the cache.
-func (dl *DataLoader) ClearAll() {
+// callBatchLoader calls the batchLoader, and the hook set by WithBatchHook. It returns
+// exactly one value per key: the keys left without a value get ErrMissingResult, and
+// the extra values are dropped. If the timeout set by WithBatchTimeout expires, all
+// the keys get an error wrapping context.DeadlineExceeded.
+func (dl *DataLoader) callBatchLoader(ctx context.Context, keys []interface{}) []Value {
+	atomic.AddUint64(&dl.stats.BatchCalls, 1)
+	atomic.AddUint64(&dl.stats.KeysFetched, uint64(len(keys)))
+	batchCtx := ctx
+	if dl.batchTimeout > 0 {
+		var cancel context.CancelFunc
+		batchCtx, cancel = context.WithTimeout(ctx, dl.batchTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	values := dl.recoverBatchLoader(batchCtx, keys)
+	if len(values) > len(keys) {
+		values = values[:len(keys)]
+	}
+	for len(values) < len(keys) {
+		values = append(values, Value{Err: ErrMissingResult})
+	}
+	if err := batchCtx.Err(); err != nil && ctx.Err() == nil {
+		// Timed out, the values may be incomplete.
+		err = fmt.Errorf("dataloader: batch timed out after %v: %w", dl.batchTimeout, err)
+		for i := range values {
+			values[i] = Value{Err: err}
+		}
+	}
+	if dl.batchHook != nil {
+		dl.batchHook(keys, values, time.Since(start))
+	}
+	return values
+}
+
+// recoverBatchLoader calls the batchLoader, turning a panic into a *BatchPanicError for
+// every key, so that the waiters are woken up rather than stuck forever.
+func (dl *DataLoader) recoverBatchLoader(ctx context.Context, keys []interface{}) (values []Value) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err := &BatchPanicError{Keys: keys, Value: r, Stack: debug.Stack()}
+		values = make([]Value, len(keys))
+		for i := range values {
+			values[i] = Value{Err: err}
+		}
+	}()
+	return dl.batchLoader(ctx, keys)
+}
+
+// BatchPanicError records a panic recovered from the batchLoader. It is the Err of the
+// values of all the keys of the batch.
+type BatchPanicError struct {
+	Keys  []interface{}
+	Value interface{}
+	Stack []byte
+}
+
+func (e *BatchPanicError) Error() string {
+	return fmt.Sprintf("dataloader: panic while loading batch of %d keys: %v", len(e.Keys), e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error, e.g. a *PanicError re-raised
+// by Parallel.
+func (e *BatchPanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// store hands the fetched values to the waiters of b, and caches them unless they were
+// invalidated during the fetch: by ClearAll, by Clear of their key, or by a more recent
+// fetch of their key.
+func (dl *DataLoader) store(b *batch, mkeys []interface{}, values []Value) {
 	dl.mu.Lock()
 	defer dl.mu.Unlock()
-	dl.cache = make(map[interface{}]Value)
+	for i, v := range values {
+		if !b.delivered[mkeys[i]] {
+			dl.storeLocked(b, mkeys[i], v)
+		}
+	}
+}
+
+// Must be called with dl.mu locked.
+func (dl *DataLoader) storeLocked(b *batch, mkey interface{}, v Value) {
+	latest := dl.inflight[mkey] == b
+	if latest {
+		delete(dl.inflight, mkey)
+	}
+	if dl.primePrecedence == PrimeWins {
+		// Primed while being fetched.
+		if dl.batchCache != nil {
+			if primed, ok := b.primed[mkey]; ok {
+				v = primed
+			}
+		} else if cached, ok := dl.cache.Get(mkey); ok && !b.fresh[mkey] {
+			v = cached
+		}
+	}
+	b.values[mkey] = v
+	stale := atomic.LoadUint64(&dl.gen) != b.gen
+	cached := !stale && latest && !b.cleared[mkey] && !b.once[mkey] && dl.cacheable(v)
+	if dl.metas != nil {
+		dl.fetchedMeta(b, mkey, cached)
+	}
+	if cached {
+		dl.set(mkey, v)
+	}
+}
+
+// set caches v for mkey, or queues the write for a BatchCache.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) set(mkey interface{}, v Value) {
+	if dl.batchCache != nil {
+		dl.writes = append(dl.writes, cacheWrite{writeSet, mkey, v})
+		return
+	}
+	dl.cache.Set(mkey, v)
+}
+
+// cacheWrite is a write to a BatchCache, queued with dl.mu locked.
+type cacheWrite struct {
+	op   writeOp
+	mkey interface{}
+	v    Value
+}
+
+type writeOp int
+
+const (
+	writeSet    writeOp = iota // Sets the value, fetched or primed with PrimeForce.
+	writePrime                 // Sets the value unless cached, see Prime.
+	writeDelete                // Deletes the value, see Clear.
+	writeClear                 // Clears the cache, see ClearAll.
+)
+
+// flushWrites does the writes queued for the BatchCache, if any, in order. It must be
+// called without dl.mu locked. The flushes are serialized, so that the writes of
+// concurrent calls still reach the cache in the order they were queued.
+func (dl *DataLoader) flushWrites() {
+	if dl.batchCache == nil {
+		return
+	}
+	dl.writeMu.Lock()
+	defer dl.writeMu.Unlock()
+	dl.mu.Lock()
+	writes := dl.writes
+	dl.writes = nil
+	dl.mu.Unlock()
+	for len(writes) > 0 {
+		// The consecutive sets are done with a single SetMany.
+		n := 0
+		for n < len(writes) && (writes[n].op == writeSet || writes[n].op == writePrime) {
+			n++
+		}
+		if n > 0 {
+			dl.setMany(writes[:n])
+			writes = writes[n:]
+			continue
+		}
+		switch w := writes[0]; w.op {
+		case writeDelete:
+			if dl.onEvict != nil {
+				if v, ok := dl.batchCache.Get(w.mkey); ok {
+					dl.evicted(w.mkey, v, EvictCleared)
+				}
+			}
+			dl.batchCache.Delete(w.mkey)
+		case writeClear:
+			if dl.onEvict != nil {
+				dl.batchCache.Range(func(k interface{}, v Value) bool {
+					dl.evicted(k, v, EvictClearedAll)
+					return true
+				})
+			}
+			dl.batchCache.Clear()
+		}
+		writes = writes[1:]
+	}
+}
+
+// setMany does consecutive writeSet and writePrime writes with a single SetMany, after
+// a single GetMany for the primed keys.
+func (dl *DataLoader) setMany(writes []cacheWrite) {
+	var primed []interface{}
+	for _, w := range writes {
+		if w.op == writePrime {
+			primed = append(primed, w.mkey)
+		}
+	}
+	var found []bool
+	if len(primed) > 0 {
+		_, found = dl.batchCache.GetMany(primed)
+	}
+	set := make(map[interface{}]bool, len(writes))
+	keys := make([]interface{}, 0, len(writes))
+	values := make([]Value, 0, len(writes))
+	for _, w := range writes {
+		if w.op == writePrime {
+			cached := found[0] || set[w.mkey]
+			found = found[1:]
+			if cached {
+				continue
+			}
+		}
+		set[w.mkey] = true
+		keys = append(keys, w.mkey)
+		values = append(values, w.v)
+	}
+	if len(keys) > 0 {
+		dl.batchCache.SetMany(keys, values)
+	}
+}
+
+// deliverKey is the context key of the function delivering the value of a single key
+// of a perKey batch being fetched.
+type deliverKey struct{}
+
+// deliver stores the value of mkey, before the rest of batch b, and wakes up the loads
+// waiting for it.
+func (dl *DataLoader) deliver(b *batch, mkey interface{}, v Value) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if _, ok := b.keys[mkey]; !ok || b.delivered[mkey] {
+		return
+	}
+	dl.storeLocked(b, mkey, v)
+	dl.delivered(b, mkey)
+}
+
+// delivered marks the value of mkey as set in b, and wakes up the loads waiting for it.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) delivered(b *batch, mkey interface{}) {
+	if b.delivered == nil {
+		b.delivered = make(map[interface{}]bool)
+	}
+	b.delivered[mkey] = true
+	if s := b.keyDone[mkey]; s != nil {
+		s.fire()
+	}
+}
+
+// keyDone returns the signal fired once the value of mkey is delivered in b, or nil if
+// it is already.
+func (dl *DataLoader) keyDone(b *batch, mkey interface{}) *signal {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if b.delivered[mkey] {
+		return nil
+	}
+	if b.keyDone == nil {
+		b.keyDone = make(map[interface{}]*signal)
+	}
+	s, ok := b.keyDone[mkey]
+	if !ok {
+		s = newSignal(dl.sch)
+		b.keyDone[mkey] = s
+	}
+	return s
+}
+
+// value returns the value of mkey in b, once delivered or b done.
+func (dl *DataLoader) value(b *batch, mkey interface{}) Value {
+	if b.perKey {
+		dl.mu.RLock()
+		defer dl.mu.RUnlock()
+	}
+	return b.values[mkey]
+}
+
+// cacheable returns whether a fetched value should be cached. Errors are not, unless
+// WithCacheErrors is set, so that a failed key is fetched again on its next load.
+// ErrNotFound is a result, cached like a value.
+func (dl *DataLoader) cacheable(v Value) bool {
+	return v.Err == nil || dl.cacheErrors || errors.Is(v.Err, ErrNotFound)
+}
+
+// enqueue adds the keys at the given positions, missing from the cache, to the pending
+// batch, unless they are already being fetched. It returns the batch to wait for each
+// of them, or nil if the key was cached in between, in which case its value is set.
+//
+// With loadFresh, the keys are added to the pending batch regardless, to be fetched
+// even if cached. With loadOnce, likewise unless already being fetched, and the fetched
+// values aren't cached. With loadDelete, the cached values are removed as they are
+// handed out, and the fetched values of the keys, even if already being fetched,
+// aren't cached.
+func (dl *DataLoader) enqueue(keys, mkeys []interface{}, missing []int, values []Value, mode loadMode) []*batch {
+	batches := make([]*batch, len(missing))
+	var newlyPending []interface{}
+	hits, deduped := len(keys)-len(missing), 0
+	func() {
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		var pending *batch
+		for j, i := range missing {
+			mkey := mkeys[i]
+			if (mode == loadCached || mode == loadDelete) && dl.batchCache == nil {
+				if v, ok := dl.cache.Get(mkey); ok {
+					if mode == loadDelete {
+						dl.cache.Delete(mkey)
+					}
+					values[i] = v
+					hits++
+					continue
+				}
+			}
+			if mode != loadFresh {
+				if b, ok := dl.inflight[mkey]; ok {
+					if mode == loadDelete {
+						b.markOnce(mkey)
+					}
+					batches[j] = b
+					deduped++
+					continue
+				}
+			}
+			b := dl.pendingBatch()
+			pending = b
+			if b.add(mkey, keys[i]) {
+				newlyPending = append(newlyPending, keys[i])
+			} else {
+				deduped++
+			}
+			switch mode {
+			case loadFresh:
+				b.markFresh(mkey)
+			case loadOnce:
+				b.markFresh(mkey)
+				b.markOnce(mkey)
+			case loadDelete:
+				b.markOnce(mkey)
+			}
+			batches[j] = b
+		}
+		if pending != nil {
+			pending.requested += len(keys)
+			pending.cacheHits += hits
+			pending.deduped += deduped
+		}
+	}()
+	atomic.AddUint64(&dl.stats.Deduped, uint64(deduped))
+	dl.flushDeferred()
+	dl.notifyPending(newlyPending)
+	return batches
+}
+
+// pendingLen returns the number of keys waiting for a fetch or being fetched.
+func (dl *DataLoader) pendingLen() int {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	n := len(dl.inflight)
+	if dl.pending != nil {
+		n += len(dl.pending.keys)
+	}
+	return n
+}
+
+// wait blocks until the given batches are fetched, or ctx is done, in which case it
+// returns ctx.Err(). The fetches go on regardless, for the other loads waiting for them.
+func (dl *DataLoader) wait(ctx context.Context, batches []*batch, mkeys []interface{}) error {
+	var last *batch
+	for j, b := range batches {
+		if b == nil {
+			continue
+		}
+		perKey := b.perKey && mkeys != nil
+		if b == last && !perKey {
+			continue
+		}
+		if b != last && dl.sch == nil {
+			if ctx.Done() == nil && !perKey {
+				dl.fetch(b)
+			} else {
+				// Fetch in the background, to be able to give up waiting, or to be
+				// woken up before the batch is done.
+				go dl.fetch(b)
+			}
+		}
+		last = b
+		if perKey {
+			if s := dl.keyDone(b, mkeys[j]); s != nil {
+				if err := s.waitEither(ctx, b.done); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := b.done.wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dl *DataLoader) notifyPending(keys []interface{}) {
+	if dl.onPending == nil {
+		return
+	}
+	for _, key := range keys {
+		dl.onPending(key)
+	}
+}
+
+func (dl *DataLoader) notifyFetched(keys []interface{}, values []Value) {
+	if dl.onFetched == nil {
+		return
+	}
+	for i, v := range values {
+		dl.onFetched(keys[i], v)
+	}
+}
+
+// Load loads a single value.
+func (dl *DataLoader) Load(key interface{}) Value {
+	return dl.LoadMany([]interface{}{
+		key,
+	})[0]
+}
+
+// MapKeyer is implemented by keys which can't be used as map keys as is, e.g. structs
+// holding a slice, or which should be deduplicated by only part of their fields. MapKey
+// must return a comparable value, preferably through ComparableKey so that the compiler
+// checks it.
+type MapKeyer interface {
+	MapKey() interface{}
+}
+
+// ComparableKey returns k as a map key. Returning it from MapKey, rather than k itself,
+// makes MapKey fail to compile when k is not comparable.
+func ComparableKey[T comparable](k T) interface{} {
+	return k
+}
+
+// CheckKey returns an error if key, or its MapKey() if key implements MapKeyer, can't be
+// used as a map key. Loading such a key panics, unless the loader maps the keys with
+// WithKeyFunc or WithKeyHasher; calling CheckKey on a sample key when setting up a
+// loader fails early instead.
+func CheckKey(key interface{}) (err error) {
+	mkey := key
+	if v, ok := key.(MapKeyer); ok {
+		mkey = v.MapKey()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("dataloader: map key %T of %T is not comparable: %v", mkey, key, r)
+		}
+	}()
+	// Hashing catches the non-comparable values held in interfaces too, which the type
+	// alone doesn't tell.
+	_ = map[interface{}]struct{}{mkey: {}}
+	return nil
+}
+
+// mapKey returns the key identifying key in the cache and the batches.
+func (dl *DataLoader) mapKey(key interface{}) interface{} {
+	if dl.keyFunc != nil {
+		return dl.keyFunc(key)
+	}
+	return getMapKey(key)
+}
+
+func getMapKey(key interface{}) interface{} {
+	if v, ok := key.(MapKeyer); ok {
+		mkey := v.MapKey()
+		if t := reflect.TypeOf(mkey); t != nil && !t.Comparable() {
+			panic(fmt.Sprintf("dataloader: MapKey of %T returned %T, which is not comparable", key, mkey))
+		}
+		return mkey
+	}
+	return key
+}
+
+// LoadMany loads multiple values.
+//
+// Keys are deduplicated against the ones already pending: concurrent loads of the same
+// keys, identical or overlapping, join the same fetch and result in a single call to
+// the batchLoader for the shared keys.
+//
+// The values are in the order of keys, whether served from the cache, from a fetch
+// started by another load, or fetched for this one. A key may appear several times in
+// keys: it is fetched once, and its value returned at each of its positions.
+func (dl *DataLoader) LoadMany(keys []interface{}) []Value {
+	if dl.sync {
+		return dl.loadManySync(keys)
+	}
+	values, mkeys, missing := dl.lookup(keys)
+	if len(missing) == 0 {
+		return values
+	}
+	return dl.load(context.Background(), keys, mkeys, missing, values, loadCached)
+}
+
+// LoadCtx is like Load, but gives up waiting for the value when ctx is done, returning
+// a Value whose Err wraps ctx.Err().
+func (dl *DataLoader) LoadCtx(ctx context.Context, key interface{}) Value {
+	return dl.LoadManyCtx(ctx, []interface{}{
+		key,
+	})[0]
+}
+
+// LoadManyCtx is like LoadMany, but gives up waiting for the values when ctx is done,
+// returning Values whose Err wraps ctx.Err() for the keys not cached yet.
+//
+// Giving up doesn't cancel the fetch, which is shared with the other loads of the same
+// keys: the fetched values are still cached. A sync loader fetches in the calling
+// goroutine, so ctx is only checked before the fetch.
+func (dl *DataLoader) LoadManyCtx(ctx context.Context, keys []interface{}) []Value {
+	ctx, span := dl.startSpan(ctx, "dataloader.load")
+	defer span.End()
+	span.SetAttribute("dataloader.keys", len(keys))
+	if dl.sync {
+		if err := ctx.Err(); err != nil {
+			values := make([]Value, len(keys))
+			for i := range values {
+				values[i] = cancelledValue(err)
+			}
+			return values
+		}
+		return dl.loadManySync(keys)
+	}
+	values, mkeys, missing := dl.lookup(keys)
+	if len(missing) == 0 {
+		return values
+	}
+	if err := ctx.Err(); err != nil {
+		for _, i := range missing {
+			values[i] = cancelledValue(err)
+		}
+		return values
+	}
+	return dl.load(ctx, keys, mkeys, missing, values, loadCached)
+}
+
+func cancelledValue(err error) Value {
+	return Value{Err: fmt.Errorf("dataloader: load cancelled: %w", err)}
+}
+
+// loadMode is how a load uses the cache.
+type loadMode int
+
+const (
+	loadCached loadMode = iota // Serves the cached values, and caches the fetched ones.
+	loadFresh                  // Fetches regardless, see LoadFresh.
+	loadOnce                   // Fetches unless being fetched, without caching, see LoadOnce.
+	loadDelete                 // Removes the cached values, and doesn't cache the fetched ones.
+)
+
+// load waits for the values of the keys at the given positions.
+func (dl *DataLoader) load(ctx context.Context, keys, mkeys []interface{}, missing []int, values []Value, mode loadMode) []Value {
+	batches := dl.enqueue(keys, mkeys, missing, values, mode)
+	return dl.await(ctx, mkeys, missing, values, batches)
+}
+
+// await waits for the batches the keys at the given positions were enqueued in, and
+// sets their values.
+func (dl *DataLoader) await(ctx context.Context, mkeys []interface{}, missing []int, values []Value, batches []*batch) []Value {
+	var waited []interface{}
+	if dl.perKey {
+		waited = make([]interface{}, len(missing))
+		for j, i := range missing {
+			waited[j] = mkeys[i]
+		}
+	}
+	if err := dl.wait(ctx, batches, waited); err != nil {
+		// Some fetches may still be running, don't look at their values.
+		cancelled := cancelledValue(err)
+		for j, i := range missing {
+			if batches[j] != nil {
+				values[i] = cancelled
+			}
+		}
+		return values
+	}
+	for j, i := range missing {
+		if b := batches[j]; b != nil {
+			values[i] = dl.value(b, mkeys[i])
+		}
+	}
+	return values
+}
+
+// LoadPriority is like Load, but with high, the fetch of the key is scheduled with
+// normal rather than low priority, for a load whose latency matters more than batching
+// it with the loads to come. The fetch is that of the pending batch the key joins: the
+// keys already in it are fetched along, and the ones joining it before it runs too.
+// Without a scheduler, it is Load.
+func (dl *DataLoader) LoadPriority(key interface{}, high bool) Value {
+	if !high || dl.sch == nil || dl.sync {
+		return dl.Load(key)
+	}
+	keys := []interface{}{key}
+	values, mkeys, missing := dl.lookup(keys)
+	if len(missing) == 0 {
+		return values[0]
+	}
+	batches := dl.enqueue(keys, mkeys, missing, values, loadCached)
+	if b := batches[0]; b != nil {
+		dl.hurry(b)
+	}
+	return dl.await(context.Background(), mkeys, missing, values, batches)[0]
+}
+
+// hurry schedules the fetch of b with normal priority, unless b is dispatched or its
+// fetch scheduled so already. The fetch scheduled with low priority finds it done.
+func (dl *DataLoader) hurry(b *batch) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if b.dispatched || b.urgent {
+		return
+	}
+	b.urgent = true
+	dl.sch.Spawn(func() {
+		dl.fetch(b)
+	})
+}
+
+// LoadThunk starts loading a single value, and returns a function waiting for it. The
+// key joins the pending batch right away, so that starting many loads before forcing
+// any of them batches them all. The function can be called several times.
+func (dl *DataLoader) LoadThunk(key interface{}) func() Value {
+	thunk := dl.LoadThunkCtx(key)
+	return func() Value {
+		return thunk(context.Background())
+	}
+}
+
+// LoadThunkCtx is like LoadThunk, with the returned function giving up waiting when its
+// context is done, like LoadCtx, e.g. for the resolver of a GraphQL field cancelled on
+// its own. Giving up doesn't cancel the fetch, which the other loads of the key still
+// wait for.
+func (dl *DataLoader) LoadThunkCtx(key interface{}) func(ctx context.Context) Value {
+	if dl.sync {
+		// Nothing to batch with.
+		return func(ctx context.Context) Value {
+			return dl.LoadCtx(ctx, key)
+		}
+	}
+	keys := []interface{}{key}
+	values, mkeys, missing := dl.lookup(keys)
+	if len(missing) == 0 {
+		return func(context.Context) Value {
+			return values[0]
+		}
+	}
+	batches := dl.enqueue(keys, mkeys, missing, values, loadCached)
+	return func(ctx context.Context) Value {
+		if err := ctx.Err(); err != nil {
+			return cancelledValue(err)
+		}
+		if err := dl.wait(ctx, batches, mkeys); err != nil {
+			return cancelledValue(err)
+		}
+		if b := batches[0]; b != nil {
+			return dl.value(b, mkeys[0])
+		}
+		// Cached in between.
+		return values[0]
+	}
+}
+
+// LoadFresh loads a single value ignoring the cached one, and caches the fetched value.
+// Concurrent LoadFresh of the same key share a single fetch. Unlike Clear followed by
+// Load, the cached value is still served to other loads until replaced.
+func (dl *DataLoader) LoadFresh(key interface{}) Value {
+	return dl.load(context.Background(), []interface{}{key}, []interface{}{dl.mapKey(key)}, []int{0}, make([]Value, 1), loadFresh)[0]
+}
+
+// LoadOnce loads a single value without caching it, like singleflight: it joins the
+// fetch of the key if in flight, or fetches it otherwise, ignoring the cached value.
+// It is meant for volatile values, to avoid both serving stale ones and a thundering
+// herd of fetches. The loads joining a LoadOnce fetch don't cache its value either.
+func (dl *DataLoader) LoadOnce(key interface{}) Value {
+	return dl.load(context.Background(), []interface{}{key}, []interface{}{dl.mapKey(key)}, []int{0}, make([]Value, 1), loadOnce)[0]
+}
+
+// lookup returns the cached values of keys, their map keys, and the positions of the
+// ones missing from the cache.
+func (dl *DataLoader) lookup(keys []interface{}) (values []Value, mkeys []interface{}, missing []int) {
+	mkeys = make([]interface{}, len(keys))
+	for i, key := range keys {
+		mkeys[i] = dl.mapKey(key)
+	}
+	// The cache is safe for concurrent use, so hits don't need to take dl.mu. Misses
+	// are checked again with dl.mu locked by enqueue, unless in a BatchCache.
+	values, found := dl.getMany(mkeys)
+	for i, ok := range found {
+		if !ok {
+			missing = append(missing, i)
+		}
+	}
+	atomic.AddUint64(&dl.stats.Hits, uint64(len(keys)-len(missing)))
+	atomic.AddUint64(&dl.stats.Misses, uint64(len(missing)))
+	dl.flushDeferred()
+	return values, mkeys, missing
+}
+
+// getMany returns the cached values of mkeys, found[i] telling whether mkeys[i] is
+// cached, with a single GetMany for a BatchCache.
+func (dl *DataLoader) getMany(mkeys []interface{}) (values []Value, found []bool) {
+	if dl.batchCache != nil {
+		return dl.batchCache.GetMany(mkeys)
+	}
+	values = make([]Value, len(mkeys))
+	found = make([]bool, len(mkeys))
+	for i, mkey := range mkeys {
+		values[i], found[i] = dl.cache.Get(mkey)
+	}
+	return values, found
+}
+
+// AwaitKeys blocks until each of keys is loaded, whether by the current task or by
+// another one. Keys neither cached nor already being loaded are fetched, like LoadMany
+// does. It lets a task proceed once data that other tasks are fetching is ready,
+// without collecting the values.
+func (dl *DataLoader) AwaitKeys(keys []interface{}) {
+	_, mkeys, missing := dl.lookup(keys)
+	if len(missing) == 0 {
+		return
+	}
+	dl.wait(context.Background(), dl.enqueue(keys, mkeys, missing, make([]Value, len(keys)), loadCached), nil)
+}
+
+func (dl *DataLoader) loadManySync(keys []interface{}) []Value {
+	defer dl.flushDeferred()
+	values := make([]Value, len(keys))
+	var keysToFetch []interface{}
+	var mkeysToFetch []interface{}
+	// Positions in values waiting for each mkey, to dedup the keys.
+	var waiting map[interface{}][]int
+
+	mkeys := make([]interface{}, len(keys))
+	for i, key := range keys {
+		mkeys[i] = dl.mapKey(key)
+	}
+	cached, found := dl.getMany(mkeys)
+	for i, key := range keys {
+		mkey := mkeys[i]
+		if found[i] {
+			atomic.AddUint64(&dl.stats.Hits, 1)
+			values[i] = cached[i]
+			continue
+		}
+		atomic.AddUint64(&dl.stats.Misses, 1)
+		if waiting == nil {
+			waiting = make(map[interface{}][]int)
+		}
+		if _, ok := waiting[mkey]; !ok {
+			keysToFetch = append(keysToFetch, key)
+			mkeysToFetch = append(mkeysToFetch, mkey)
+		} else {
+			atomic.AddUint64(&dl.stats.Deduped, 1)
+		}
+		waiting[mkey] = append(waiting[mkey], i)
+	}
+	if len(keysToFetch) == 0 {
+		return values
+	}
+
+	dl.notifyPending(keysToFetch)
+	if dl.onBatchStats != nil {
+		fetched := len(keysToFetch)
+		missed := 0
+		for _, positions := range waiting {
+			missed += len(positions)
+		}
+		dl.onBatchStats(BatchStats{Requested: len(keys), CacheHits: len(keys) - missed, Deduped: missed - fetched, Fetched: fetched})
+	}
+	dl.waitResumed()
+	gen := atomic.LoadUint64(&dl.gen)
+	start := time.Now()
+	fetched := dl.loadBatch(context.Background(), keysToFetch)
+	meta := Meta{FetchedAt: time.Now(), BatchDuration: time.Since(start)}
+	func() {
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		// Don't cache the values fetched before a ClearAll.
+		stale := atomic.LoadUint64(&dl.gen) != gen
+		for i, mkey := range mkeysToFetch {
+			if !stale && dl.cacheable(fetched[i]) {
+				if dl.metas != nil {
+					dl.setMeta(mkey, meta)
+				}
+				dl.set(mkey, fetched[i])
+			}
+			for _, vi := range waiting[mkey] {
+				values[vi] = fetched[i]
+			}
+		}
+	}()
+	dl.notifyFetched(keysToFetch, fetched)
+	return values
+}
+
+// LoadAndDelete loads a single value, then removes it from the cache, so that the next
+// load fetches it again. It is meant for values to be consumed once. Loads waiting for
+// the same fetch still all get the value, which isn't cached. With a BatchCache, shared
+// with other loaders, the value may be handed out to them too.
+func (dl *DataLoader) LoadAndDelete(key interface{}) Value {
+	defer dl.flushDeferred()
+	mkey := dl.mapKey(key)
+	if dl.batchCache != nil {
+		if v, ok := dl.batchCache.Get(mkey); ok {
+			dl.batchCache.Delete(mkey)
+			return v
+		}
+	}
+	return dl.load(context.Background(), []interface{}{key}, []interface{}{mkey}, []int{0}, make([]Value, 1), loadDelete)[0]
+}
+
+// Prefetch starts loading keys in the background and returns right away. Loads of
+// these keys later hit the cache, or join the fetch if it isn't done yet. With a
+// scheduler, the keys join the pending batch, fetched with low priority as usual.
+// Without one, the batch is fetched by a new goroutine.
+//
+// With WithPrefetchQueue, the prefetched keys wait in a bounded queue for the next
+// fetch, and the ones in excess are dropped.
+func (dl *DataLoader) Prefetch(keys []interface{}) {
+	defer dl.flushDeferred()
+	var newlyPending []interface{}
+	mkeys := make([]interface{}, len(keys))
+	for i, key := range keys {
+		mkeys[i] = dl.mapKey(key)
+	}
+	cached := func(i int) bool {
+		_, ok := dl.cache.Get(mkeys[i])
+		return ok
+	}
+	if dl.batchCache != nil {
+		// Looked up before locking dl.mu.
+		_, found := dl.batchCache.GetMany(mkeys)
+		cached = func(i int) bool { return found[i] }
+	}
+	b := func() *batch {
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		for i, key := range keys {
+			mkey := mkeys[i]
+			if cached(i) {
+				continue
+			}
+			if _, ok := dl.inflight[mkey]; ok {
+				continue
+			}
+			if dl.prefetchMax > 0 {
+				dl.queuePrefetch(prefetchKey{key, mkey})
+				continue
+			}
+			b := dl.pendingBatch()
+			if b.add(mkey, key) {
+				newlyPending = append(newlyPending, key)
+			}
+		}
+		if len(newlyPending) == 0 && len(dl.prefetchQ) == 0 {
+			return nil
+		}
+		return dl.pendingBatch()
+	}()
+	dl.notifyPending(newlyPending)
+	if b != nil && dl.sch == nil {
+		go dl.fetch(b)
+	}
+}
+
+type prefetchKey struct {
+	key, mkey interface{}
+}
+
+// queuePrefetch adds a key to the bounded prefetch queue, dropping a key if it is full.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) queuePrefetch(k prefetchKey) {
+	if b := dl.pending; b != nil {
+		if _, ok := b.keys[k.mkey]; ok {
+			return
+		}
+	}
+	for _, queued := range dl.prefetchQ {
+		if queued.mkey == k.mkey {
+			return
+		}
+	}
+	if len(dl.prefetchQ) >= dl.prefetchMax {
+		dl.prefetchDropped++
+		if dl.prefetchPolicy == DropNewest {
+			return
+		}
+		copy(dl.prefetchQ, dl.prefetchQ[1:])
+		dl.prefetchQ = dl.prefetchQ[:len(dl.prefetchQ)-1]
+	}
+	dl.prefetchQ = append(dl.prefetchQ, k)
+}
+
+// PrefetchDropped returns the number of prefetched keys dropped because the prefetch
+// queue was full.
+func (dl *DataLoader) PrefetchDropped() uint64 {
+	dl.mu.RLock()
+	defer dl.mu.RUnlock()
+	return dl.prefetchDropped
+}
+
+// Stats counts what a loader did since its creation.
+type Stats struct {
+	// Hits and Misses count the keys loaded found in the cache or not.
+	Hits   uint64
+	Misses uint64
+	// Deduped counts the keys missing from the cache which joined a fetch of the same
+	// key, pending or in flight, rather than being fetched again.
+	Deduped uint64
+	// BatchCalls counts the calls to the batchLoader, KeysFetched the keys passed.
+	BatchCalls  uint64
+	KeysFetched uint64
+	// Primes counts the values primed into the cache.
+	Primes uint64
+}
+
+// BatchStats tells how well the loads coalesced into a batch, see WithBatchStats. Of
+// the keys Requested by the loads joining the batch, CacheHits were served from the
+// cache, Deduped joined a fetch of the same key, in this batch or in flight, and the
+// other ones were Fetched, in a single call to the batchLoader unless split by
+// WithMaxBatchSize.
+type BatchStats struct {
+	Requested int
+	CacheHits int
+	Deduped   int
+	Fetched   int
+}
+
+// Stats returns a snapshot of the counters of dl. The counters only grow, so that two
+// snapshots can be diffed.
+func (dl *DataLoader) Stats() Stats {
+	return Stats{
+		Hits:        atomic.LoadUint64(&dl.stats.Hits),
+		Misses:      atomic.LoadUint64(&dl.stats.Misses),
+		Deduped:     atomic.LoadUint64(&dl.stats.Deduped),
+		BatchCalls:  atomic.LoadUint64(&dl.stats.BatchCalls),
+		KeysFetched: atomic.LoadUint64(&dl.stats.KeysFetched),
+		Primes:      atomic.LoadUint64(&dl.stats.Primes),
+	}
+}
+
+// Pause stops the loader from fetching until Resume is called: loads of keys missing
+// from the cache wait, cooperatively when there is a scheduler, while the cached ones
+// are still served. It allows to quiesce the traffic to the backend for a moment
+// without failing loads.
+func (dl *DataLoader) Pause() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.paused == nil {
+		dl.paused = newSignal(dl.sch)
+	}
+}
+
+// Resume lets the loader fetch again after Pause, waking the loads that waited.
+func (dl *DataLoader) Resume() {
+	dl.mu.Lock()
+	paused := dl.paused
+	dl.paused = nil
+	dl.mu.Unlock()
+	if paused != nil {
+		paused.fire()
+	}
+}
+
+// waitResumed blocks while the loader is paused.
+func (dl *DataLoader) waitResumed() {
+	for {
+		dl.mu.RLock()
+		paused := dl.paused
+		dl.mu.RUnlock()
+		if paused == nil {
+			return
+		}
+		paused.wait(context.Background())
+	}
+}
+
+// Warm loads keys into the cache and blocks until they are loaded, returning the first
+// error among their values. It is meant to pre-populate reference data at startup.
+// progress, if not nil, is called with the number of keys loaded so far. With
+// WithMaxBatchSize, the keys are loaded one batch at a time, calling progress in
+// between. Once ctx is done, it stops waiting and returns ctx.Err().
+func (dl *DataLoader) Warm(ctx context.Context, keys []interface{}, progress func(loaded, total int)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	chunk := len(keys)
+	if dl.maxBatchSize > 0 {
+		chunk = dl.maxBatchSize
+	}
+	for start := 0; start < len(keys); start += chunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := start + chunk
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values := dl.LoadManyCtx(ctx, keys[start:end])
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(end, len(keys))
+		}
+		for _, v := range values {
+			if v.Err != nil {
+				return v.Err
+			}
+		}
+	}
+	return nil
+}
+
+// Prime put a single value into the cache. No-op if the value already exists, see
+// PrimeForce.
+//
+// If the key is waiting for a fetch, by default the loads waiting for it get the primed
+// value and the key isn't fetched, see WithPrimePrecedence.
+func (dl *DataLoader) Prime(key interface{}, v Value) {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.prime(dl.mapKey(key), v, false)
+}
+
+// PrimeForce is like Prime, but replaces the value if already cached. Unlike Clear
+// followed by Prime, no load can fetch the key in between, so it is meant for seeding
+// the value written by a mutation.
+func (dl *DataLoader) PrimeForce(key interface{}, v Value) {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.prime(dl.mapKey(key), v, true)
+}
+
+// PrimeWithTTL is like Prime, but the value expires ttl after being primed rather than
+// after the TTL set with WithTTL, if any, or never with a zero ttl. Values of the key
+// fetched later on get the TTL of WithTTL again.
+func (dl *DataLoader) PrimeWithTTL(key interface{}, v Value, ttl time.Duration) {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	c, ok := dl.cache.(expiringCache)
+	if !ok {
+		// WithoutCache.
+		dl.prime(dl.mapKey(key), v, false)
+		return
+	}
+	dl.primeWith(dl.mapKey(key), v, false, func(mkey interface{}, v Value) {
+		c.setWithTTL(mkey, v, ttl)
+	})
+}
+
+// PrimeMany is like Prime for several keys at once, with values[i] the value of keys[i].
+// It panics if the lengths differ.
+func (dl *DataLoader) PrimeMany(keys []interface{}, values []Value) {
+	if len(keys) != len(values) {
+		panic(fmt.Sprintf("dataloader: PrimeMany got %d keys but %d values", len(keys), len(values)))
+	}
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for i, key := range keys {
+		dl.prime(dl.mapKey(key), values[i], false)
+	}
+}
+
+// Must be called with dl.mu locked.
+func (dl *DataLoader) prime(mkey interface{}, v Value, force bool) {
+	dl.primeWith(mkey, v, force, dl.set)
+}
+
+// primeWith is prime, storing the value with set.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) primeWith(mkey interface{}, v Value, force bool, set func(mkey interface{}, v Value)) {
+	if dl.batchCache != nil {
+		// Unless forced, the write checks that the key isn't cached once flushed.
+		op := writePrime
+		if force {
+			op = writeSet
+		}
+		dl.writes = append(dl.writes, cacheWrite{op, mkey, v})
+		if b, ok := dl.inflight[mkey]; ok && !b.fresh[mkey] {
+			if b.primed == nil {
+				b.primed = make(map[interface{}]Value)
+			}
+			b.primed[mkey] = v
+		}
+	} else {
+		if _, ok := dl.cache.Get(mkey); ok && !force {
+			// If you want to override, use PrimeForce.
+			return
+		}
+		set(mkey, v)
+	}
+	atomic.AddUint64(&dl.stats.Primes, 1)
+	if dl.metas != nil {
+		dl.setMeta(mkey, Meta{FetchedAt: time.Now()})
+	}
+	dl.resolvePending(mkey, v)
+}
+
+// resolvePending hands a value primed for a pending key to the loads waiting for it,
+// so that the key isn't fetched. If it was the only key of the batch, they are woken
+// right away.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) resolvePending(mkey interface{}, v Value) {
+	b := dl.pending
+	if b == nil || b.fresh[mkey] {
+		return
+	}
+	if _, ok := b.keys[mkey]; !ok {
+		return
+	}
+	if dl.primePrecedence == FetchWins {
+		b.markFresh(mkey)
+		return
+	}
+	delete(b.keys, mkey)
+	b.values[mkey] = v
+	if b.once[mkey] {
+		// Consumed by LoadAndDelete.
+		if dl.batchCache != nil {
+			dl.writes = append(dl.writes, cacheWrite{writeDelete, mkey, Value{}})
+		} else {
+			dl.cache.Delete(mkey)
+		}
+	}
+	if b.perKey {
+		dl.delivered(b, mkey)
+	}
+	if len(b.keys) == 0 {
+		// The fetch scheduled for the batch will find it dispatched.
+		b.dispatched = true
+		b.gen = atomic.LoadUint64(&dl.gen)
+		dl.pending = nil
+		b.done.fire()
+	}
+}
+
+// Clear removes a single value from the cache. If the key is being fetched, the
+// fetched value won't be cached.
+func (dl *DataLoader) Clear(key interface{}) {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.clear(dl.mapKey(key))
+}
+
+// ClearMany removes the values of keys from the cache, all at once.
+func (dl *DataLoader) ClearMany(keys []interface{}) {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for _, key := range keys {
+		dl.clear(dl.mapKey(key))
+	}
+}
+
+// ClearWhere removes the values whose map key matches pred, e.g. all the keys of a
+// tenant after a mutation, see MapKeyer. Like with Clear, the matching keys being
+// fetched won't be cached.
+func (dl *DataLoader) ClearWhere(pred func(key interface{}) bool) {
+	defer dl.flushDeferred()
+	var mkeys []interface{}
+	match := func(mkey interface{}, v Value) bool {
+		if pred(mkey) {
+			mkeys = append(mkeys, mkey)
+		}
+		return true
+	}
+	if dl.batchCache != nil {
+		dl.cache.Range(match)
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.batchCache == nil {
+		dl.cache.Range(match)
+	}
+	for mkey := range dl.inflight {
+		if pred(mkey) {
+			mkeys = append(mkeys, mkey)
+		}
+	}
+	for _, mkey := range mkeys {
+		dl.clear(mkey)
+	}
+}
+
+// clear removes a value from the cache, and keeps a fetch in flight from caching it.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) clear(mkey interface{}) {
+	if dl.batchCache != nil {
+		dl.writes = append(dl.writes, cacheWrite{writeDelete, mkey, Value{}})
+	} else {
+		if dl.onEvict != nil {
+			if v, ok := dl.cache.Get(mkey); ok {
+				dl.evicted(mkey, v, EvictCleared)
+			}
+		}
+		dl.cache.Delete(mkey)
+	}
+	dl.dropMeta(mkey)
+	if b, ok := dl.inflight[mkey]; ok {
+		if b.cleared == nil {
+			b.cleared = make(map[interface{}]bool)
+		}
+		b.cleared[mkey] = true
+	}
+}
+
+// Merge copies the cached values of other into dl, priming them: values already cached
+// in dl are kept, and the loads of dl waiting for the keys get them. It is meant for
+// folding a scratch loader's results back into a shared one.
+func (dl *DataLoader) Merge(other *DataLoader) {
+	dl.merge(other, false)
+}
+
+// MergeForce is like Merge, but values from other replace the ones already cached in
+// dl.
+func (dl *DataLoader) MergeForce(other *DataLoader) {
+	dl.merge(other, true)
+}
+
+func (dl *DataLoader) merge(other *DataLoader, force bool) {
+	if dl == other {
+		return
+	}
+	// Always lock the two loaders in the same order, so that two concurrent merges in
+	// opposite directions can't deadlock.
+	first, second := dl, other
+	if other.id < dl.id {
+		first, second = other, dl
+	}
+	defer dl.flushDeferred()
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	second.mu.Lock()
+	defer second.mu.Unlock()
+
+	other.cache.Range(func(k interface{}, v Value) bool {
+		dl.prime(k, v, force)
+		return true
+	})
+}
+
+// Snapshot returns a copy of the cache, e.g. to persist it and Restore it later. The
+// keys are the map keys, see MapKeyer.
+func (dl *DataLoader) Snapshot() map[interface{}]Value {
+	defer dl.readLock()()
+	m := make(map[interface{}]Value, dl.cache.Len())
+	dl.cache.Range(func(k interface{}, v Value) bool {
+		m[k] = v
+		return true
+	})
+	return m
+}
+
+// Range calls f for each cached value, until f returns false, like sync.Map.Range. The
+// keys are the map keys, see MapKeyer. Loads may run concurrently, but f must not
+// modify the cache, e.g. with Prime or Clear, which would deadlock.
+func (dl *DataLoader) Range(f func(key interface{}, v Value) bool) {
+	defer dl.readLock()()
+	dl.cache.Range(f)
+}
+
+// readLock read-locks dl.mu to read the cache, unless it is a BatchCache, and returns
+// the function unlocking it.
+func (dl *DataLoader) readLock() (unlock func()) {
+	if dl.batchCache != nil {
+		return func() {}
+	}
+	dl.mu.RLock()
+	return dl.mu.RUnlock
+}
+
+// Restore primes the cache with the values of a Snapshot. Values already cached are
+// kept, like Prime.
+func (dl *DataLoader) Restore(m map[interface{}]Value) {
+	dl.restore(m, false)
+}
+
+// RestoreForce is like Restore, but the values of m replace the ones already cached.
+func (dl *DataLoader) RestoreForce(m map[interface{}]Value) {
+	dl.restore(m, true)
+}
+
+func (dl *DataLoader) restore(m map[interface{}]Value, force bool) {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for mkey, v := range m {
+		dl.prime(mkey, v, force)
+	}
+}
+
+// Has returns whether the value of key is cached, without loading it otherwise, e.g. to
+// only prefetch the keys not loaded yet.
+func (dl *DataLoader) Has(key interface{}) bool {
+	defer dl.flushDeferred()
+	defer dl.readLock()()
+	_, ok := dl.cache.Get(dl.mapKey(key))
+	return ok
+}
+
+// Len returns the number of values in the cache, including the expired values not
+// removed yet, see RemoveExpired.
+func (dl *DataLoader) Len() int {
+	return dl.cache.Len()
+}
+
+// RemoveExpired removes the values older than their TTL, see WithTTL and PrimeWithTTL.
+// Expired values are never returned, but are otherwise only removed when accessed: call
+// it periodically to reclaim the memory of values that aren't loaded again.
+func (dl *DataLoader) RemoveExpired() {
+	defer dl.flushDeferred()
+	if c, ok := dl.cache.(expiringCache); ok {
+		dl.mu.Lock()
+		defer dl.mu.Unlock()
+		c.removeExpired()
+	}
+}
+
+// ClearAll removes all values from the cache. The values of the fetches in flight won't
+// be cached, but the loads from then on still join them, see Invalidate.
+func (dl *DataLoader) ClearAll() {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.clearAll()
+}
+
+// Invalidate is like ClearAll, and moreover the loads from then on don't join the
+// fetches in flight, which may have read data older than a known write: every key is
+// fetched again. The loads already waiting are still served by their fetches.
+func (dl *DataLoader) Invalidate() {
+	defer dl.flushDeferred()
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.clearAll()
+	for mkey := range dl.inflight {
+		delete(dl.inflight, mkey)
+	}
+}
+
+// Must be called with dl.mu locked.
+func (dl *DataLoader) clearAll() {
+	atomic.AddUint64(&dl.gen, 1)
+	if dl.batchCache != nil {
+		// The writes queued before are moot.
+		dl.writes = []cacheWrite{{op: writeClear}}
+	} else {
+		if dl.onEvict != nil {
+			dl.cache.Range(func(k interface{}, v Value) bool {
+				dl.evicted(k, v, EvictClearedAll)
+				return true
+			})
+		}
+		dl.cache.Clear()
+	}
+	if dl.metas != nil {
+		dl.metaMu.Lock()
+		dl.metas = make(map[interface{}]Meta)
+		dl.metaMu.Unlock()
+	}
 }
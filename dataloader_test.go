@@ -1,9 +1,16 @@
 package dataloader_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/bigdrum/godataloader"
 )
@@ -153,3 +160,1988 @@ func TestNoScheduler(t *testing.T) {
 		t.Error(fmt.Sprintf("%#v", vs))
 	}
 }
+
+func TestMerge(t *testing.T) {
+	echo := dataloader.Serial(func(key interface{}) dataloader.Value {
+		return dataloader.NewValue(key, nil)
+	})
+	shared := dataloader.New(nil, echo)
+	scratch := dataloader.New(nil, echo)
+	shared.Prime("a", dataloader.NewValue("shared_a", nil))
+	scratch.Prime("a", dataloader.NewValue("scratch_a", nil))
+	scratch.Prime("b", dataloader.NewValue("scratch_b", nil))
+
+	shared.Merge(scratch)
+	if v := shared.Load("a").V; v != "shared_a" {
+		t.Error("merge should not overwrite, got", v)
+	}
+	if v := shared.Load("b").V; v != "scratch_b" {
+		t.Error("expect merged value, got", v)
+	}
+
+	shared.MergeForce(scratch)
+	if v := shared.Load("a").V; v != "scratch_a" {
+		t.Error("force merge should overwrite, got", v)
+	}
+
+	// Merging in both directions at once must not deadlock.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			shared.Merge(scratch)
+		}()
+		go func() {
+			defer wg.Done()
+			scratch.Merge(shared)
+		}()
+	}
+	wg.Wait()
+
+	// The merged values resolve the pending loads, like primed ones.
+	var fetched []interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			fetched = append(fetched, keys...)
+			return make([]dataloader.Value, len(keys))
+		})
+		sch.Spawn(func() {
+			dl.Merge(scratch)
+		})
+		sch.Spawn(func() { // Runs first.
+			if v := dl.Load("b").V; v != "scratch_b" {
+				t.Error("expect the merged value, got", v)
+			}
+		})
+	})
+	if len(fetched) != 0 {
+		t.Error("expect the merged key not fetched, got", fetched)
+	}
+}
+
+func panicOnB(key interface{}) dataloader.Value {
+	if key == "b" {
+		panic("boom")
+	}
+	return dataloader.NewValue(key, nil)
+}
+
+func TestParallelPanicRecover(t *testing.T) {
+	f := dataloader.Parallel(panicOnB, dataloader.WithParallelPanicPolicy(dataloader.PanicRecover))
+	values := f([]interface{}{"a", "b", "c"})
+	if values[0].V != "a" || values[2].V != "c" {
+		t.Error("unexpected values:", values)
+	}
+	perr, ok := values[1].Err.(*dataloader.PanicError)
+	if !ok {
+		t.Fatalf("expect *PanicError, got %#v", values[1].Err)
+	}
+	if perr.Key != "b" || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Errorf("unexpected panic error: %#v", perr)
+	}
+
+	values = f([]interface{}{"b"})
+	if _, ok := values[0].Err.(*dataloader.PanicError); !ok {
+		t.Errorf("expect *PanicError for a single key, got %#v", values[0].Err)
+	}
+}
+
+func TestParallelPanicPropagate(t *testing.T) {
+	for _, keys := range [][]interface{}{{"a", "b", "c"}, {"b"}} {
+		func() {
+			defer func() {
+				r := recover()
+				if perr, ok := r.(*dataloader.PanicError); !ok || perr.Key != "b" {
+					t.Errorf("expect a *PanicError for %v, got %#v", keys, r)
+				}
+			}()
+			dataloader.Parallel(panicOnB)(keys)
+		}()
+	}
+}
+
+func TestParallelN(t *testing.T) {
+	var inflight, maxInflight int32
+	f := dataloader.ParallelN(3, func(key interface{}) dataloader.Value {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return dataloader.NewValue(key.(int)*2, nil)
+	})
+	keys := make([]interface{}, 20)
+	for i := range keys {
+		keys[i] = i
+	}
+	for i, v := range f(keys) {
+		if v.V != i*2 {
+			t.Errorf("expect value %d at %d, got %v", i*2, i, v)
+		}
+	}
+	if max := atomic.LoadInt32(&maxInflight); max < 1 || max > 3 {
+		t.Error("expect at most 3 fetches in flight, got", max)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	var remoteKeys []interface{}
+	local := dataloader.Serial(func(key interface{}) dataloader.Value {
+		if key == "a" {
+			return dataloader.NewValue("local a", nil)
+		}
+		return dataloader.NotFound()
+	})
+	remote := func(keys []interface{}) []dataloader.Value {
+		remoteKeys = append(remoteKeys, keys...)
+		// Short of a value for the last key.
+		values := make([]dataloader.Value, len(keys)-1)
+		for i := range values {
+			values[i] = dataloader.NewValue(fmt.Sprint("remote ", keys[i]), nil)
+		}
+		return values
+	}
+	values := dataloader.Fallback(local, remote)([]interface{}{"b", "a", "c"})
+	if fmt.Sprint(remoteKeys) != "[b c]" {
+		t.Error("expect only the misses passed on, got", remoteKeys)
+	}
+	if values[0].V != "remote b" || values[1].V != "local a" || values[2].Err != dataloader.ErrMissingResult {
+		t.Error("unexpected values", values)
+	}
+
+	remoteKeys = nil
+	dataloader.Fallback(local, remote)([]interface{}{"a"})
+	if remoteKeys != nil {
+		t.Error("expect no call without misses, got", remoteKeys)
+	}
+}
+
+func TestParallelCtx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var fetched []interface{}
+	var mu sync.Mutex
+	f := dataloader.ParallelCtx(func(ctx context.Context, key interface{}) dataloader.Value {
+		mu.Lock()
+		fetched = append(fetched, key)
+		mu.Unlock()
+		if key == "slow" {
+			cancel()
+			<-ctx.Done()
+			return dataloader.NewValue(nil, ctx.Err())
+		}
+		return dataloader.NewValue(key, nil)
+	})
+	values := f(ctx, []interface{}{"slow"})
+	if !errors.Is(values[0].Err, context.Canceled) {
+		t.Error("expect the started fetch to observe the cancellation, got", values)
+	}
+
+	fetched = nil
+	values = f(ctx, []interface{}{"a", "b"})
+	for _, v := range values {
+		if !errors.Is(v.Err, context.Canceled) {
+			t.Error("expect ctx.Err() for the keys not fetched, got", v)
+		}
+	}
+	if len(fetched) != 0 {
+		t.Error("expect no fetch once cancelled, got", fetched)
+	}
+
+	// With NewCtx, the single fetches get the timeout of the batch.
+	dl := dataloader.NewCtx(nil, dataloader.ParallelCtx(func(ctx context.Context, key interface{}) dataloader.Value {
+		<-ctx.Done()
+		return dataloader.NewValue(nil, ctx.Err())
+	}), dataloader.WithBatchTimeout(time.Millisecond))
+	for _, v := range dl.LoadMany([]interface{}{"a", "b"}) {
+		if !errors.Is(v.Err, context.DeadlineExceeded) {
+			t.Error("expect the single fetches to time out with the batch, got", v)
+		}
+	}
+}
+
+func TestSyncLoaderMatchesScheduler(t *testing.T) {
+	steps := [][]interface{}{
+		{"a", "a", "b"},
+		{"a", "b", "c"},
+		{"c"},
+	}
+	run := func(newLoader func(batch func(keys []interface{}) []dataloader.Value) *dataloader.DataLoader) (results, batches []string) {
+		dl := newLoader(func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, fmt.Sprint(keys))
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(fmt.Sprint(len(batches), key), nil)
+			}
+			return values
+		})
+		for _, keys := range steps {
+			results = append(results, fmt.Sprint(dl.LoadMany(keys)))
+		}
+		return results, batches
+	}
+
+	syncResults, syncBatches := run(func(batch func(keys []interface{}) []dataloader.Value) *dataloader.DataLoader {
+		return dataloader.NewSync(batch)
+	})
+	var schResults, schBatches []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		schResults, schBatches = run(func(batch func(keys []interface{}) []dataloader.Value) *dataloader.DataLoader {
+			return dataloader.New(sch, batch)
+		})
+	})
+
+	if fmt.Sprint(syncResults) != fmt.Sprint(schResults) {
+		t.Errorf("results differ:\nsync:      %v\nscheduler: %v", syncResults, schResults)
+	}
+	if len(syncBatches) != 2 || len(schBatches) != 2 {
+		t.Errorf("expect 2 batches, got sync: %v, scheduler: %v", syncBatches, schBatches)
+	}
+	if syncBatches[0] != "[a b]" {
+		t.Errorf("expect deduplicated keys, got %v", syncBatches[0])
+	}
+}
+
+func TestWarm(t *testing.T) {
+	var batches int
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		batches++
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			if key == "bad" {
+				values[i] = dataloader.NewValue(nil, errors.New("bad key"))
+				continue
+			}
+			values[i] = dataloader.NewValue(key, nil)
+		}
+		return values
+	})
+
+	var loaded int
+	err := dl.Warm(context.Background(), []interface{}{"a", "b", "c"}, func(n, total int) {
+		loaded = n
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 {
+		t.Error("expect progress to report 3 keys, got", loaded)
+	}
+	dl.LoadMany([]interface{}{"a", "b", "c"})
+	if batches != 1 {
+		t.Error("expect warmed keys to be cached, batches:", batches)
+	}
+
+	if err := dl.Warm(context.Background(), []interface{}{"a", "bad"}, nil); err == nil || err.Error() != "bad key" {
+		t.Error("expect warm to report the error, got", err)
+	}
+
+	slow := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		time.Sleep(200 * time.Millisecond)
+		return make([]dataloader.Value, len(keys))
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := slow.Warm(ctx, []interface{}{"a"}, nil); err != context.DeadlineExceeded {
+		t.Error("expect warm to stop at the deadline, got", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Error("expect warm to return at the deadline, took", d)
+	}
+}
+
+func TestConcurrentIdenticalLoadMany(t *testing.T) {
+	keys := []interface{}{"a", "b", "c", "d"}
+	newLoader := func(sch *dataloader.Scheduler, calls *int32) *dataloader.DataLoader {
+		return dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			atomic.AddInt32(calls, 1)
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(key, nil)
+			}
+			return values
+		})
+	}
+	check := func(values []dataloader.Value) {
+		if fmt.Sprint(values) != "[{a <nil>} {b <nil>} {c <nil>} {d <nil>}]" {
+			t.Error("unexpected values:", values)
+		}
+	}
+
+	var calls int32
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := newLoader(sch, &calls)
+		for i := 0; i < 2; i++ {
+			sch.Spawn(func() {
+				check(dl.LoadMany(keys))
+			})
+		}
+	})
+	if calls != 1 {
+		t.Error("expect a single batch with a scheduler, got", calls)
+	}
+
+	for round := 0; round < 100; round++ {
+		calls = 0
+		dl := newLoader(nil, &calls)
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				check(dl.LoadMany(keys))
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if calls != 1 {
+			t.Fatal("expect a single batch without a scheduler, got", calls)
+		}
+	}
+}
+
+func TestLoadManyOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 50; round++ {
+		keys := r.Perm(30)
+		primed, inflight := keys[:10], keys[10:20]
+		want := append([]int(nil), keys[10:]...)
+		sort.Ints(want)
+		var fetched []int
+		held := false
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			dispatched := dataloader.NewNotification(sch)
+			release := dataloader.NewNotification(sch)
+			dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				values := make([]dataloader.Value, len(keys))
+				for i, key := range keys {
+					fetched = append(fetched, key.(int))
+					values[i] = dataloader.NewValue(key.(int)*10, nil)
+				}
+				if !held {
+					// Keep the first batch in flight while the other load joins it.
+					held = true
+					dispatched.Notify()
+					release.Wait()
+				}
+				return values
+			})
+			for _, key := range primed {
+				dl.Prime(key, dataloader.NewValue(key*10, nil))
+			}
+			sch.Spawn(func() {
+				dispatched.Wait()
+				sch.Spawn(release.Notify)
+				all := make([]interface{}, len(keys))
+				for i, j := range r.Perm(len(keys)) {
+					all[i] = keys[j]
+				}
+				for i, v := range dl.LoadMany(all) {
+					if v.Err != nil || v.V != all[i].(int)*10 {
+						t.Errorf("round %d: expect %d at %d, got %v", round, all[i].(int)*10, i, v)
+						return
+					}
+				}
+			})
+			sch.Spawn(func() {
+				some := make([]interface{}, len(inflight))
+				for i, key := range inflight {
+					some[i] = key
+				}
+				for i, v := range dl.LoadMany(some) {
+					if v.V != some[i].(int)*10 {
+						t.Errorf("round %d: expect %d at %d, got %v", round, some[i].(int)*10, i, v)
+						return
+					}
+				}
+			})
+		})
+		sort.Ints(fetched)
+		if fmt.Sprint(fetched) != fmt.Sprint(want) {
+			t.Fatalf("round %d: expect the uncached keys to be fetched once, got %v", round, fetched)
+		}
+	}
+}
+
+func TestLoadManyDuplicateKeys(t *testing.T) {
+	var fetched []string
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			fetched = append(fetched, key.(string))
+			values[i] = dataloader.NewValue(key.(string)+"!", nil)
+		}
+		return values
+	}
+	check := func(name string, load func() []dataloader.Value) {
+		fetched = nil
+		values := load()
+		sort.Strings(fetched)
+		if fmt.Sprint(values) != "[{a! <nil>} {a! <nil>} {b! <nil>} {a! <nil>}]" || fmt.Sprint(fetched) != "[a b]" {
+			t.Errorf("%s: expect a single fetch of a, got %v, fetched: %v", name, values, fetched)
+		}
+	}
+	keys := []interface{}{"a", "a", "b", "a"}
+
+	check("no scheduler", func() []dataloader.Value {
+		return dataloader.New(nil, batchLoader).LoadMany(keys)
+	})
+	check("sync", func() []dataloader.Value {
+		return dataloader.NewSync(batchLoader).LoadMany(keys)
+	})
+	check("without cache", func() []dataloader.Value {
+		return dataloader.New(nil, batchLoader, dataloader.WithoutCache()).LoadMany(keys)
+	})
+	check("scheduler", func() (values []dataloader.Value) {
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			values = dataloader.New(sch, batchLoader).LoadMany(keys)
+		})
+		return values
+	})
+}
+
+func benchmarkManyKeys(b *testing.B, opts ...dataloader.Option) {
+	keys := make([]interface{}, 5000)
+	for i := range keys {
+		keys[i] = i
+	}
+	echo := dataloader.Serial(func(key interface{}) dataloader.Value {
+		return dataloader.NewValue(key, nil)
+	})
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dataloader.New(nil, echo, opts...).LoadMany(keys)
+	}
+}
+
+func BenchmarkManyKeys(b *testing.B) {
+	benchmarkManyKeys(b)
+}
+
+func BenchmarkManyKeysWithCapHints(b *testing.B) {
+	benchmarkManyKeys(b, dataloader.WithInitialCacheCap(5000), dataloader.WithInitialPendingCap(5000))
+}
+
+func BenchmarkManyKeysWithCapacity(b *testing.B) {
+	benchmarkManyKeys(b, dataloader.WithInitialCapacity(5000))
+}
+
+func TestKeyLifecycleHooks(t *testing.T) {
+	pending := map[interface{}]int{}
+	fetched := map[interface{}]int{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		var dl *dataloader.DataLoader
+		dl = dataloader.New(sch, dataloader.Serial(func(key interface{}) dataloader.Value {
+			return dataloader.NewValue(key, nil)
+		}), dataloader.WithOnPending(func(key interface{}) {
+			pending[key]++
+		}), dataloader.WithOnFetched(func(key interface{}, v dataloader.Value) {
+			fetched[key]++
+			if v.V != key {
+				t.Error("unexpected value for", key, v)
+			}
+			// Hooks run outside of the lock, re-entering the loader is fine.
+			dl.Prime("hooked", dataloader.NewValue(nil, nil))
+		}))
+		for i := 0; i < 3; i++ {
+			sch.Spawn(func() {
+				dl.LoadMany([]interface{}{"a", "b"})
+				dl.Load("c")
+			})
+		}
+	})
+	for _, key := range []string{"a", "b", "c"} {
+		if pending[key] != 1 || fetched[key] != 1 {
+			t.Errorf("expect hooks to fire once for %v, pending: %d, fetched: %d", key, pending[key], fetched[key])
+		}
+	}
+}
+
+func TestAwaitKeys(t *testing.T) {
+	var batches int
+	var awaited bool
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			batches++
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(key, nil)
+			}
+			return values
+		})
+		keys := []interface{}{"a", "b"}
+		// Spawned tasks run last first: the loading task registers the keys before
+		// the awaiting one runs.
+		sch.Spawn(func() {
+			dl.AwaitKeys(keys)
+			awaited = true
+			if fmt.Sprint(dl.LoadMany(keys)) != "[{a <nil>} {b <nil>}]" {
+				t.Error("expect keys to be loaded")
+			}
+		})
+		sch.Spawn(func() {
+			dl.LoadMany(keys)
+		})
+	})
+	if !awaited {
+		t.Error("AwaitKeys never returned")
+	}
+	if batches != 1 {
+		t.Error("expect AwaitKeys to join the pending fetch, got batches:", batches)
+	}
+}
+
+func TestLoadAndDelete(t *testing.T) {
+	var calls int32
+	newLoader := func(sch *dataloader.Scheduler) *dataloader.DataLoader {
+		return dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			n := atomic.AddInt32(&calls, 1)
+			values := make([]dataloader.Value, len(keys))
+			for i := range keys {
+				values[i] = dataloader.NewValue(n, nil)
+			}
+			return values
+		})
+	}
+
+	var got []interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := newLoader(sch)
+		for i := 0; i < 4; i++ {
+			i := i
+			sch.Spawn(func() {
+				if i%2 == 0 {
+					got = append(got, dl.LoadAndDelete("token").V)
+				} else {
+					got = append(got, dl.Load("token").V)
+				}
+			})
+		}
+		// Runs after the first fetch.
+		sch.SpawnLow(func() {
+			if v := dl.Load("token").V; v != int32(2) {
+				t.Error("expect the deleted value to be fetched again, got", v)
+			}
+		})
+	})
+	if fmt.Sprint(got) != "[1 1 1 1]" {
+		t.Error("expect all the waiters to get the value, got", got)
+	}
+
+	calls = 0
+	dl := newLoader(nil)
+	dl.Prime("token", dataloader.NewValue("primed", nil))
+	var wg sync.WaitGroup
+	var consumed int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if dl.LoadAndDelete("token").V == "primed" {
+				atomic.AddInt32(&consumed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed != 1 {
+		t.Error("expect the cached value to be consumed once, got", consumed)
+	}
+
+	// The fetched value is never cached, not even until the load returns.
+	var cachedWhileFetched bool
+	dl = dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithOnFetched(func(key interface{}, v dataloader.Value) {
+		cachedWhileFetched = dl.Has(key)
+	}))
+	dl.LoadAndDelete("token")
+	if cachedWhileFetched || dl.Has("token") {
+		t.Error("expect the fetched value not to be cached")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var events []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			events = append(events, "fetch")
+			return make([]dataloader.Value, len(keys))
+		})
+		dl.Prime("cached", dataloader.NewValue(nil, nil))
+		dl.Pause()
+		// Low priority tasks run last first: this one runs after the fetch task
+		// found the loader paused.
+		sch.SpawnLow(func() {
+			events = append(events, "resume")
+			dl.Resume()
+		})
+		sch.Spawn(func() {
+			dl.Load("missing")
+			events = append(events, "loaded")
+		})
+		sch.Spawn(func() {
+			dl.Load("cached")
+			events = append(events, "hit")
+		})
+	})
+	if fmt.Sprint(events) != "[hit resume fetch loaded]" {
+		t.Error("unexpected events:", events)
+	}
+
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.Pause()
+	loaded := make(chan struct{})
+	go func() {
+		dl.Load("missing")
+		close(loaded)
+	}()
+	select {
+	case <-loaded:
+		t.Fatal("expect the load to wait while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	dl.Resume()
+	<-loaded
+}
+
+func TestLoadFresh(t *testing.T) {
+	var calls int
+	var got []interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			calls++
+			return []dataloader.Value{dataloader.NewValue("fresh", nil)}
+		})
+		dl.Prime("key", dataloader.NewValue("stale", nil))
+		for i := 0; i < 5; i++ {
+			sch.Spawn(func() {
+				got = append(got, dl.LoadFresh("key").V)
+			})
+		}
+		sch.SpawnLow(func() {
+			if v := dl.Load("key").V; v != "fresh" {
+				t.Error("expect the fresh value to be cached, got", v)
+			}
+		})
+	})
+	if calls != 1 {
+		t.Error("expect concurrent LoadFresh to share a fetch, got", calls)
+	}
+	if fmt.Sprint(got) != "[fresh fresh fresh fresh fresh]" {
+		t.Error("unexpected values:", got)
+	}
+}
+
+func TestLoadOnce(t *testing.T) {
+	var calls int
+	var got []interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			calls++
+			return []dataloader.Value{dataloader.NewValue(calls, nil)}
+		})
+		dl.Prime("key", dataloader.NewValue("stale", nil))
+		wg := dataloader.NewWaitGroup(sch)
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			sch.Spawn(func() {
+				defer wg.Done()
+				got = append(got, dl.LoadOnce("key").V)
+			})
+		}
+		wg.Wait()
+		if v := dl.LoadOnce("key").V; v != 2 {
+			t.Error("expect a new fetch once the first is done, got", v)
+		}
+		dl.Clear("key")
+		dl.LoadOnce("key")
+		if dl.Has("key") {
+			t.Error("expect the value not to be cached")
+		}
+	})
+	if fmt.Sprint(got) != "[1 1 1]" {
+		t.Error("expect concurrent LoadOnce to share a fetch, ignoring the cache, got", got)
+	}
+}
+
+func TestPrimeResolvesPendingLoad(t *testing.T) {
+	var fetched []interface{}
+	var events []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			fetched = append(fetched, keys...)
+			return make([]dataloader.Value, len(keys))
+		})
+		// Spawned tasks run last first: the loads are pending when Prime runs.
+		sch.Spawn(func() {
+			// A normal priority task, which runs before the fetch, but after the load
+			// woken up by Prime.
+			sch.Spawn(func() {
+				events = append(events, "normal")
+			})
+			dl.Prime("alone", dataloader.NewValue("primed", nil))
+			events = append(events, "primed")
+		})
+		sch.Spawn(func() {
+			if v := dl.Load("alone").V; v != "primed" {
+				t.Error("expect the primed value, got", v)
+			}
+			events = append(events, "loaded")
+		})
+	})
+	if len(fetched) != 0 {
+		t.Error("expect no fetch for the primed key, got", fetched)
+	}
+	// The waiter is woken by Prime, not by the fetch task which runs last.
+	if fmt.Sprint(events) != "[primed loaded normal]" {
+		t.Error("unexpected events:", events)
+	}
+
+	fetched = nil
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			fetched = append(fetched, keys...)
+			return make([]dataloader.Value, len(keys))
+		})
+		sch.Spawn(func() {
+			dl.Prime("a", dataloader.NewValue("primed", nil))
+		})
+		sch.Spawn(func() {
+			if v := dl.LoadMany([]interface{}{"a", "b"})[0].V; v != "primed" {
+				t.Error("expect the primed value, got", v)
+			}
+		})
+	})
+	if fmt.Sprint(fetched) != "[b]" {
+		t.Error("expect only the other key to be fetched, got", fetched)
+	}
+}
+
+func TestPrimePrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		precedence dataloader.PrimePrecedence
+		// Primed before or while the fetch runs.
+		primeDuringFetch bool
+		want             string
+		wantFetched      bool
+	}{
+		{dataloader.PrimeWins, false, "primed", false},
+		{dataloader.PrimeWins, true, "primed", true},
+		{dataloader.FetchWins, false, "fetched", true},
+		{dataloader.FetchWins, true, "fetched", true},
+	} {
+		var fetched bool
+		var loaded, cached interface{}
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			var dl *dataloader.DataLoader
+			dl = dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				fetched = true
+				if tc.primeDuringFetch {
+					dl.Prime("key", dataloader.NewValue("primed", nil))
+				}
+				return []dataloader.Value{dataloader.NewValue("fetched", nil)}
+			}, dataloader.WithPrimePrecedence(tc.precedence))
+			if !tc.primeDuringFetch {
+				sch.Spawn(func() {
+					dl.Prime("key", dataloader.NewValue("primed", nil))
+				})
+			}
+			sch.Spawn(func() {
+				loaded = dl.Load("key").V
+			})
+			sch.SpawnLow(func() {
+				cached = dl.Load("key").V
+			})
+		})
+		if loaded != tc.want || cached != tc.want || fetched != tc.wantFetched {
+			t.Errorf("%+v: loaded %v, cached %v, fetched %v", tc, loaded, cached, fetched)
+		}
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	var batches []string
+	var mu sync.Mutex
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, fmt.Sprint(len(keys)))
+		return make([]dataloader.Value, len(keys))
+	}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, batchLoader)
+		dl.Prefetch([]interface{}{"a", "b"})
+		// Joins the pending batch.
+		dl.Load("a")
+		dl.Load("b")
+	})
+	if fmt.Sprint(batches) != "[2]" {
+		t.Error("expect the loads to join the prefetch, got", batches)
+	}
+
+	batches = nil
+	dl := dataloader.New(nil, batchLoader)
+	dl.Prefetch([]interface{}{"a"})
+	dl.Load("a")
+	dl.Load("a")
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(batches) != "[1]" {
+		t.Error("expect the loads to join the prefetch, got", batches)
+	}
+}
+
+func TestPrefetchQueue(t *testing.T) {
+	for _, tc := range []struct {
+		policy dataloader.DropPolicy
+		want   string
+	}{
+		{dataloader.DropNewest, "[a b c]"},
+		{dataloader.DropOldest, "[c d e]"},
+	} {
+		var fetched []string
+		var dropped uint64
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				for _, key := range keys {
+					fetched = append(fetched, key.(string))
+				}
+				return make([]dataloader.Value, len(keys))
+			}, dataloader.WithPrefetchQueue(3, tc.policy))
+			dl.Prefetch([]interface{}{"a", "b", "a"})
+			dl.Prefetch([]interface{}{"c", "d", "e"})
+			dropped = dl.PrefetchDropped()
+		})
+		sort.Strings(fetched)
+		if fmt.Sprint(fetched) != tc.want {
+			t.Errorf("policy %v: expect %v fetched, got %v", tc.policy, tc.want, fetched)
+		}
+		if dropped != 2 {
+			t.Errorf("policy %v: expect 2 keys dropped, got %d", tc.policy, dropped)
+		}
+	}
+}
+
+func TestClearDuringFetch(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		clear         func(dl *dataloader.DataLoader)
+		wantRefetched string
+	}{
+		{"ClearAll", func(dl *dataloader.DataLoader) { dl.ClearAll() }, "[a b]"},
+		{"Clear", func(dl *dataloader.DataLoader) { dl.Clear("a") }, "[a]"},
+	} {
+		var fetched []string
+		var loaded []dataloader.Value
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			var dl *dataloader.DataLoader
+			dl = dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				for _, key := range keys {
+					fetched = append(fetched, key.(string))
+				}
+				if len(fetched) == 2 {
+					// Cleared while the first fetch runs.
+					tc.clear(dl)
+				}
+				return dataloader.Serial(func(key interface{}) dataloader.Value {
+					return dataloader.NewValue(key, nil)
+				})(keys)
+			})
+			sch.Spawn(func() {
+				loaded = dl.LoadMany([]interface{}{"a", "b"})
+			})
+			sch.SpawnLow(func() {
+				fetched = nil
+				dl.LoadMany([]interface{}{"a", "b"})
+			})
+		})
+		if fmt.Sprint(loaded) != "[{a <nil>} {b <nil>}]" {
+			t.Errorf("%s: expect the waiters to get the fetched values, got %v", tc.name, loaded)
+		}
+		sort.Strings(fetched)
+		if fmt.Sprint(fetched) != tc.wantRefetched {
+			t.Errorf("%s: expect cleared keys to be fetched again, got %v", tc.name, fetched)
+		}
+	}
+
+	// Same without a scheduler, clearing from another goroutine.
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(fetching)
+			<-release
+		}
+		return make([]dataloader.Value, len(keys))
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dl.Load("a")
+	}()
+	<-fetching
+	dl.ClearAll()
+	close(release)
+	<-done
+	dl.Load("a")
+	if calls != 2 {
+		t.Error("expect the value fetched before ClearAll not to be cached, calls:", calls)
+	}
+
+	// And with a sync loader.
+	calls = 0
+	dl = dataloader.NewSync(func(keys []interface{}) []dataloader.Value {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			dl.ClearAll()
+		}
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.Load("a")
+	if dl.Has("a") || dl.Len() != 0 {
+		t.Error("expect the value fetched before ClearAll not to be cached by a sync loader")
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		n := atomic.AddInt32(&calls, 1)
+		if n == 1 {
+			close(fetching)
+			<-release
+		}
+		return []dataloader.Value{dataloader.NewValue(n, nil)}
+	})
+	done := make(chan dataloader.Value)
+	go func() {
+		done <- dl.Load("a")
+	}()
+	<-fetching
+	dl.Invalidate()
+	if v := dl.Load("a"); v.V != int32(2) {
+		t.Error("expect a load after Invalidate to fetch again, got", v)
+	}
+	close(release)
+	if v := <-done; v.V == nil {
+		t.Error("expect the waiting load to be served, got", v)
+	}
+	if v := dl.Load("a"); v.V != int32(2) || calls != 2 {
+		t.Error("expect the value fetched after Invalidate cached, got", v, calls)
+	}
+}
+
+func TestErrorsNotCached(t *testing.T) {
+	for _, syncLoad := range []bool{false, true} {
+		for _, cacheErrors := range []bool{false, true} {
+			var calls int
+			batchLoader := func(keys []interface{}) []dataloader.Value {
+				calls++
+				values := make([]dataloader.Value, len(keys))
+				for i, key := range keys {
+					if key == "bad" && calls == 1 {
+						values[i].Err = errors.New("transient")
+					}
+				}
+				return values
+			}
+			opt := dataloader.WithCacheErrors(cacheErrors)
+			dl := dataloader.New(nil, batchLoader, opt)
+			if syncLoad {
+				dl = dataloader.NewSync(batchLoader, opt)
+			}
+			if _, err := dl.Load("bad").Unbox(); err == nil {
+				t.Error("expect the first load to fail")
+			}
+			dl.Load("good")
+			_, err := dl.Load("bad").Unbox()
+			if cacheErrors {
+				if err == nil || calls != 2 {
+					t.Errorf("sync %v: expect the error to be cached, err: %v, calls: %d", syncLoad, err, calls)
+				}
+			} else if err != nil || calls != 3 {
+				t.Errorf("sync %v: expect the failed key to be fetched again, err: %v, calls: %d", syncLoad, err, calls)
+			}
+		}
+	}
+}
+
+func TestBatchPanic(t *testing.T) {
+	var calls int
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		return make([]dataloader.Value, len(keys))
+	}
+	for _, dl := range []*dataloader.DataLoader{
+		dataloader.New(nil, batchLoader),
+		dataloader.NewSync(batchLoader),
+	} {
+		calls = 0
+		var values []dataloader.Value
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			values = dl.LoadMany([]interface{}{"a", "b"})
+		})
+		for _, v := range values {
+			var pe *dataloader.BatchPanicError
+			if !errors.As(v.Err, &pe) || pe.Value != "boom" || len(pe.Keys) != 2 || len(pe.Stack) == 0 {
+				t.Error("expect a BatchPanicError, got:", v.Err)
+			}
+		}
+		// Errors aren't cached, the keys are fetched again.
+		if _, err := dl.Load("a").Unbox(); err != nil || calls != 2 {
+			t.Errorf("expect a successful refetch, err: %v, calls: %d", err, calls)
+		}
+	}
+
+	// A panic re-raised by Parallel can be unwrapped.
+	dl := dataloader.New(nil, dataloader.Parallel(func(key interface{}) dataloader.Value {
+		if key == "bad" {
+			panic("bad key")
+		}
+		return dataloader.Value{}
+	}))
+	var pe *dataloader.PanicError
+	if _, err := dl.LoadMany([]interface{}{"good", "bad"})[0].Unbox(); !errors.As(err, &pe) || pe.Key != "bad" {
+		t.Error("expect the PanicError of the bad key, got:", err)
+	}
+}
+
+func TestMissingResult(t *testing.T) {
+	var n int
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		values := make([]dataloader.Value, n)
+		for i := range values {
+			values[i] = dataloader.NewValue("extra", nil)
+			if i < len(keys) {
+				values[i] = dataloader.NewValue(keys[i], nil)
+			}
+		}
+		return values
+	}
+	for _, dl := range []*dataloader.DataLoader{
+		dataloader.New(nil, batchLoader),
+		dataloader.NewSync(batchLoader),
+	} {
+		for _, n = range []int{1, 4} {
+			dl.ClearAll()
+			keys := []interface{}{"a", "b", "c"}
+			var values []dataloader.Value
+			dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+				values = dl.LoadMany(keys)
+			})
+			if len(values) != 3 {
+				t.Fatalf("%d results: expect a value per key, got %v", n, values)
+			}
+			missing := 0
+			for i, v := range values {
+				switch {
+				case errors.Is(v.Err, dataloader.ErrMissingResult):
+					missing++
+				case v.Err != nil || v.V != keys[i]:
+					t.Errorf("%d results: expect the value of %v, got %v", n, keys[i], v)
+				}
+			}
+			if want := map[int]int{1: 2, 4: 0}[n]; missing != want {
+				t.Errorf("%d results: expect %d ErrMissingResult, got %v", n, want, values)
+			}
+		}
+	}
+}
+
+func TestIncompleteBatch(t *testing.T) {
+	// A value for the first key only: the tasks sharing the batch must get
+	// ErrMissingResult for the others, cached for the later loads.
+	var calls [][]interface{}
+	type result struct {
+		key interface{}
+		v   dataloader.Value
+	}
+	var results []result
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			calls = append(calls, keys)
+			return []dataloader.Value{dataloader.NewValue(keys[0], nil)}
+		}, dataloader.WithCacheErrors(true))
+		wg := dataloader.NewWaitGroup(sch)
+		for _, keys := range [][]interface{}{{"a"}, {"a", "b"}, {"b", "c"}} {
+			keys := keys
+			wg.Add(1)
+			sch.Spawn(func() {
+				defer wg.Done()
+				for i, v := range dl.LoadMany(keys) {
+					results = append(results, result{keys[i], v})
+				}
+			})
+		}
+		wg.Wait()
+		for _, key := range []interface{}{"a", "b", "c"} {
+			results = append(results, result{key, dl.Load(key)})
+		}
+	})
+	if len(calls) != 1 || len(calls[0]) != 3 {
+		t.Fatal("expect a single batch of the 3 keys, got", calls)
+	}
+	if len(results) != 8 {
+		t.Fatal("unexpected results", results)
+	}
+	for _, r := range results {
+		if r.key == calls[0][0] {
+			if r.v.Err != nil || r.v.V != r.key {
+				t.Errorf("%v: expect the value, got %v", r.key, r.v)
+			}
+		} else if !errors.Is(r.v.Err, dataloader.ErrMissingResult) {
+			t.Errorf("%v: expect ErrMissingResult, got %v", r.key, r.v)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var calls int
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		calls++
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			if key == "missing" {
+				values[i] = dataloader.NotFound()
+				continue
+			}
+			values[i].Err = fmt.Errorf("loading %v: %w", key, dataloader.ErrNotFound)
+		}
+		return values
+	}
+	dl := dataloader.New(nil, batchLoader, dataloader.WithRetry(3, nil))
+	for i := 0; i < 2; i++ {
+		values := dl.LoadMany([]interface{}{"missing", "wrapped"})
+		for _, v := range values {
+			if !errors.Is(v.Err, dataloader.ErrNotFound) {
+				t.Error("expect ErrNotFound, got", v)
+			}
+		}
+	}
+	if calls != 1 {
+		t.Error("expect ErrNotFound to be cached and not retried, got calls:", calls)
+	}
+}
+
+func TestNewWithMap(t *testing.T) {
+	var got [][]interface{}
+	batchLoader := func(keys []interface{}) map[interface{}]dataloader.Value {
+		got = append(got, keys)
+		m := make(map[interface{}]dataloader.Value)
+		for _, key := range keys {
+			if u, ok := key.(userKey); ok && u.id != 0 {
+				m[u.MapKey()] = dataloader.NewValue(u.id*10, nil)
+			}
+		}
+		return m
+	}
+	var values []dataloader.Value
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.NewWithMap(sch, batchLoader)
+		values = dl.LoadMany([]interface{}{userKey{id: 2}, userKey{id: 0}, userKey{id: 1}})
+	})
+	if len(got) != 1 {
+		t.Error("expect a single batch, got", got)
+	}
+	if values[0].V != 20 || values[2].V != 10 {
+		t.Error("expect the values by key, got", values)
+	}
+	if !errors.Is(values[1].Err, dataloader.ErrMissingResult) {
+		t.Error("expect ErrMissingResult for the absent key, got", values[1])
+	}
+}
+
+func TestEagerFetch(t *testing.T) {
+	for _, eager := range []bool{false, true} {
+		var batches []string
+		batchLoader := func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, fmt.Sprint(len(keys)))
+			return make([]dataloader.Value, len(keys))
+		}
+		var opts []dataloader.Option
+		if eager {
+			opts = append(opts, dataloader.WithEagerFetch())
+		}
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			dl := dataloader.New(sch, batchLoader, opts...)
+			for i := 0; i < 2; i++ {
+				i := i
+				sch.Spawn(func() {
+					dl.Load(i)
+				})
+			}
+		})
+		want := "[2]"
+		if eager {
+			// The fetch of the first key runs before the second task.
+			want = "[1 1]"
+		}
+		if fmt.Sprint(batches) != want {
+			t.Errorf("eager %v: expect batches %s, got %v", eager, want, batches)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var batches []string
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		batches = append(batches, fmt.Sprint(keys))
+		return make([]dataloader.Value, len(keys))
+	}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, batchLoader)
+		dl.Flush()
+		a := dl.LoadThunk("a")
+		dl.Flush()
+		if fmt.Sprint(batches) != "[[a]]" {
+			t.Error("expect the pending batch fetched by Flush, got", batches)
+		}
+		b := dl.LoadThunk("b")
+		a()
+		b()
+	})
+	if fmt.Sprint(batches) != "[[a] [b]]" {
+		t.Error("expect the loads after Flush in a new batch, got", batches)
+	}
+
+	batches = nil
+	dl := dataloader.New(nil, batchLoader, dataloader.WithBatchWindow(time.Hour))
+	a := dl.LoadThunk("a")
+	dl.Flush()
+	if v := a(); v.Err != nil || fmt.Sprint(batches) != "[[a]]" {
+		t.Error("expect Flush not to wait for the window, got", batches)
+	}
+}
+
+func TestBatchWindow(t *testing.T) {
+	var batches []string
+	var mu sync.Mutex
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, fmt.Sprint(len(keys)))
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithBatchWindow(20*time.Millisecond))
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dl.Load(i)
+		}(i)
+	}
+	wg.Wait()
+	if fmt.Sprint(batches) != "[3]" {
+		t.Error("expect the concurrent loads to be batched together, got", batches)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Error("expect the fetch to wait for the window")
+	}
+}
+
+func TestNewWithBatchErr(t *testing.T) {
+	errDown := errors.New("backend down")
+	keyErr := errors.New("invalid key")
+	dl := dataloader.NewWithBatchErr(nil, func(keys []interface{}) ([]dataloader.Value, error) {
+		if keys[0] == "b" {
+			return nil, errDown
+		}
+		// The backend failed after loading some keys.
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			switch key {
+			case "cached":
+				values[i] = dataloader.NewValue(key, nil)
+			case "invalid":
+				values[i].Err = keyErr
+			}
+		}
+		return values, errDown
+	})
+	values := dl.LoadMany([]interface{}{"cached", "invalid", "a"})
+	if values[0].V != "cached" || values[1].Err != keyErr || values[2].Err != errDown {
+		t.Error("expect the batch error for the keys without a value, got", values)
+	}
+	if v := dl.Load("b"); v.Err != errDown {
+		t.Error("expect the batch error for the keys beyond the values, got", v)
+	}
+	if v := dl.Load("cached"); v.V != "cached" {
+		t.Error("unexpected value:", v)
+	}
+}
+
+func TestNewStreaming(t *testing.T) {
+	var events []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		fastLoaded := dataloader.NewNotification(sch)
+		dl := dataloader.NewStreaming(sch, func(keys []interface{}, emit func(key interface{}, v dataloader.Value)) {
+			emit("fast", dataloader.NewValue("fast!", nil))
+			emit("ignored", dataloader.NewValue("ignored", nil))
+			// The slow key is only emitted once the fast one is served.
+			fastLoaded.Wait()
+			emit("slow", dataloader.NewValue("slow!", nil))
+			emit("fast", dataloader.NewValue("again", nil))
+		}, dataloader.WithMaxBatchSize(10))
+		sch.Spawn(func() {
+			v := dl.LoadMany([]interface{}{"slow", "missing"})
+			events = append(events, fmt.Sprint(v))
+		})
+		sch.Spawn(func() {
+			v := dl.Load("fast")
+			events = append(events, fmt.Sprint(v))
+			fastLoaded.Notify()
+		})
+	}, dataloader.WithDeadlockDetection())
+	want := fmt.Sprint([]string{"{fast! <nil>}", fmt.Sprint([]dataloader.Value{dataloader.NewValue("slow!", nil), {Err: dataloader.ErrMissingResult}})})
+	if fmt.Sprint(events) != want {
+		t.Errorf("expect %s, got %s", want, events)
+	}
+
+	// Without a scheduler.
+	release := make(chan struct{})
+	dl := dataloader.NewStreaming(nil, func(keys []interface{}, emit func(key interface{}, v dataloader.Value)) {
+		emit("fast", dataloader.NewValue("fast!", nil))
+		<-release
+		emit("slow", dataloader.NewValue("slow!", nil))
+	}, dataloader.WithBatchWindow(10*time.Millisecond))
+	slow := make(chan dataloader.Value)
+	go func() {
+		slow <- dl.Load("slow")
+	}()
+	if v := dl.Load("fast"); v.V != "fast!" {
+		t.Error("unexpected value:", v)
+	}
+	close(release)
+	if v := <-slow; v.V != "slow!" {
+		t.Error("unexpected value:", v)
+	}
+	if !dl.Has("fast") || !dl.Has("slow") {
+		t.Error("expect the emitted values cached")
+	}
+}
+
+func TestPerKeyNotify(t *testing.T) {
+	var events []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		aLoaded := dataloader.NewNotification(sch)
+		attempts := 0
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			attempts++
+			if attempts > 1 {
+				// Retrying b, once a is served.
+				aLoaded.Wait()
+			}
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				if key == "b" && attempts == 1 {
+					values[i].Err = errors.New("transient")
+					continue
+				}
+				values[i] = dataloader.NewValue(key, nil)
+			}
+			return values
+		}, dataloader.WithPerKeyNotify(), dataloader.WithRetry(1, nil))
+		sch.Spawn(func() {
+			events = append(events, fmt.Sprint(dl.Load("b")))
+		})
+		sch.Spawn(func() {
+			events = append(events, fmt.Sprint(dl.Load("a")))
+			aLoaded.Notify()
+		})
+	}, dataloader.WithDeadlockDetection())
+	if fmt.Sprint(events) != "[{a <nil>} {b <nil>}]" {
+		t.Error("expect a served before b is retried, got", events)
+	}
+}
+
+func TestMinBatchSizeAfterPrime(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.NewConcurrent(func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(key, nil)
+		}
+		return values
+	}, time.Hour, 2)
+	a := dl.LoadThunk("a")
+	b := dl.LoadThunk("b") // Fills the batch.
+	dl.Prime("a", dataloader.NewValue("primed", nil))
+	c := dl.LoadThunk("c") // Fills it again.
+	if got := fmt.Sprint([]interface{}{a().V, b().V, c().V}); got != "[primed b c]" {
+		t.Error("unexpected values", got)
+	}
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].(string) < fetched[j].(string) })
+	if fmt.Sprint(fetched) != "[b c]" {
+		t.Error("expect the keys left fetched, got", fetched)
+	}
+}
+
+func TestNewConcurrent(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	fetched := make(map[interface{}]int)
+	dl := dataloader.NewConcurrent(func(keys []interface{}) []dataloader.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, len(keys))
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			fetched[key]++
+			values[i] = dataloader.NewValue(key.(int)*10, nil)
+		}
+		return values
+	}, 100*time.Millisecond, 25)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Overlapping keys, so that some loads join the fetches of others.
+			keys := []interface{}{i % 50, (i + 1) % 50}
+			for j, v := range dl.LoadMany(keys) {
+				if v.V != keys[j].(int)*10 {
+					t.Errorf("expect %d, got %v", keys[j].(int)*10, v)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(fetched) != 50 {
+		t.Error("expect all the keys fetched, got", len(fetched))
+	}
+	for key, n := range fetched {
+		if n != 1 {
+			t.Errorf("expect %v fetched once, got %d", key, n)
+		}
+	}
+	for _, n := range batches[:len(batches)-1] {
+		if n < 25 {
+			t.Error("expect the batches to be filled before the window ends, got", batches)
+		}
+	}
+}
+
+func TestMinBatchSize(t *testing.T) {
+	var batches []string
+	var mu sync.Mutex
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, fmt.Sprint(len(keys)))
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithMinBatchSize(3, 50*time.Millisecond))
+
+	// Reached n.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dl.Load(i)
+		}(i)
+	}
+	wg.Wait()
+	if fmt.Sprint(batches) != "[3]" || time.Since(start) >= 50*time.Millisecond {
+		t.Errorf("expect a batch of 3 fetched without waiting, got %v in %v", batches, time.Since(start))
+	}
+
+	// Hit the timeout.
+	batches = nil
+	start = time.Now()
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, fmt.Sprint(len(keys)))
+			return make([]dataloader.Value, len(keys))
+		}, dataloader.WithMinBatchSize(3, 20*time.Millisecond))
+		dl.Load("a")
+	}, dataloader.WithDeadlockDetection())
+	if fmt.Sprint(batches) != "[1]" || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("expect a batch of 1 fetched after the timeout, got %v in %v", batches, time.Since(start))
+	}
+}
+
+func TestNewCtx(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "request")
+	var got []interface{}
+	var values []dataloader.Value
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.NewCtx(sch, func(ctx context.Context, keys []interface{}) []dataloader.Value {
+			got = append(got, ctx.Value(key{}))
+			if keys[0] == "slow" {
+				<-ctx.Done()
+			}
+			return make([]dataloader.Value, len(keys))
+		}, dataloader.WithBatchTimeout(10*time.Millisecond))
+		dl.Load("fast")
+		values = dl.LoadMany([]interface{}{"slow"})
+	}, dataloader.WithSchedulerContext(ctx))
+	if fmt.Sprint(got) != "[request request]" {
+		t.Error("expect the batchLoader to get the scheduler context, got", got)
+	}
+	if !errors.Is(values[0].Err, context.DeadlineExceeded) {
+		t.Error("expect the batch to time out, got", values)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	var sizes []int
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		sizes = append(sizes, len(keys))
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(key, nil)
+		}
+		return values
+	}
+	keys := []interface{}{1, 2, 3, 4, 5}
+	var values []dataloader.Value
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, batchLoader, dataloader.WithMaxBatchSize(2))
+		values = dl.LoadMany(keys)
+	})
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Error("expect the batch to be split in chunks of 2, got:", sizes)
+	}
+	for i, v := range values {
+		if v.V != keys[i] {
+			t.Errorf("expect value %v at %d, got %v", keys[i], i, v.V)
+		}
+	}
+
+	sizes = nil
+	var progress []int
+	dl := dataloader.New(nil, batchLoader, dataloader.WithMaxBatchSize(2))
+	err := dl.Warm(context.Background(), keys, func(loaded, total int) {
+		progress = append(progress, loaded)
+	})
+	if err != nil || fmt.Sprint(progress) != "[2 4 5]" || fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Errorf("expect warm to load one batch at a time, err: %v, progress: %v, sizes: %v", err, progress, sizes)
+	}
+}
+
+func TestLoadCtx(t *testing.T) {
+	var calls int32
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		atomic.AddInt32(&calls, 1)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(key, nil)
+		}
+		return values
+	}
+
+	// Give up waiting for a paused fetch, which still serves another load.
+	atomic.StoreInt32(&calls, 0)
+	var cancelled, other dataloader.Value
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, batchLoader)
+		dl.Pause()
+		sch.Spawn(func() {
+			other = dl.Load("a")
+		})
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		cancelled = dl.LoadCtx(ctx, "a")
+		dl.Resume()
+	})
+	if !errors.Is(cancelled.Err, context.DeadlineExceeded) {
+		t.Error("expect the load to be cancelled, got:", cancelled)
+	}
+	if other.V != "a" || calls != 1 {
+		t.Errorf("expect the fetch to go on for the other load, got %v, calls: %d", other, calls)
+	}
+
+	// Same without a scheduler.
+	atomic.StoreInt32(&calls, 0)
+	dl := dataloader.New(nil, batchLoader)
+	dl.Pause()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		other = dl.Load("a")
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	cancelled = dl.LoadCtx(ctx, "a")
+	dl.Resume()
+	<-done
+	if !errors.Is(cancelled.Err, context.DeadlineExceeded) {
+		t.Error("expect the load to be cancelled, got:", cancelled)
+	}
+	if other.V != "a" || calls != 1 {
+		t.Errorf("expect the fetch to go on for the other load, got %v, calls: %d", other, calls)
+	}
+
+	// With a done context, cached values are still served.
+	v := dl.LoadManyCtx(ctx, []interface{}{"a", "b"})
+	if v[0].V != "a" || v[1].Err == nil || calls != 1 {
+		t.Errorf("unexpected values: %v, calls: %d", v, calls)
+	}
+}
+
+type userKey struct {
+	id   int
+	name string // Ignored, not part of the identity.
+}
+
+func (k userKey) MapKey() interface{} {
+	return dataloader.ComparableKey(k.id)
+}
+
+type tagsKey struct {
+	tags []string
+}
+
+func (k tagsKey) MapKey() interface{} {
+	return k.tags
+}
+
+func TestWithKeyFunc(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(key, nil)
+		}
+		return values
+	}, dataloader.WithKeyFunc(func(key interface{}) interface{} {
+		return strings.ToLower(key.(string))
+	}))
+	values := dl.LoadMany([]interface{}{"Alice", "ALICE"})
+	if len(fetched) != 1 || fetched[0] != values[0].V || fetched[0] != values[1].V {
+		t.Errorf("expect a single fetch of an original key, got %v, fetched: %v", values, fetched)
+	}
+	if v := dl.Load("alice"); len(fetched) != 1 || v.V != fetched[0] {
+		t.Error("expect the normalized key cached, got", v, fetched)
+	}
+	dl.Clear("aLiCe")
+	dl.Prime("BOB", dataloader.NewValue("primed", nil))
+	fetched = nil
+	values = dl.LoadMany([]interface{}{"alice", "bob"})
+	if fmt.Sprint(fetched) != "[alice]" || values[1].V != "primed" {
+		t.Errorf("expect Clear and Prime to use the key func, got %v, fetched: %v", values, fetched)
+	}
+
+	dl = dataloader.NewWithMap(nil, func(keys []interface{}) map[interface{}]dataloader.Value {
+		return map[interface{}]dataloader.Value{"alice": dataloader.NewValue(1, nil)}
+	}, dataloader.WithKeyFunc(func(key interface{}) interface{} {
+		return strings.ToLower(key.(string))
+	}))
+	if v := dl.Load("Alice"); v.V != 1 {
+		t.Error("expect the map indexed by the key func, got", v)
+	}
+}
+
+func TestWithKeyHasher(t *testing.T) {
+	type query struct {
+		table string
+		ids   []int
+	}
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(len(key.(query).ids), nil)
+		}
+		return values
+	}, dataloader.WithKeyHasher(func(key interface{}) string {
+		return fmt.Sprint(key)
+	}))
+	values := dl.LoadMany([]interface{}{query{"users", []int{1, 2}}, query{"users", []int{1, 2}}, query{"posts", []int{3}}})
+	if values[0].V != 2 || values[1].V != 2 || values[2].V != 1 {
+		t.Error("unexpected values:", values)
+	}
+	if len(fetched) != 2 {
+		t.Error("expect the keys with the same hash fetched once, got", fetched)
+	}
+	if _, ok := fetched[0].(query); !ok {
+		t.Errorf("expect the original keys fetched, got %T", fetched[0])
+	}
+	dl.Clear(query{"users", []int{1, 2}})
+	if dl.Has(query{"users", []int{1, 2}}) || !dl.Has(query{"posts", []int{3}}) {
+		t.Error("expect Clear to use the hash")
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	if err := dataloader.CheckKey(userKey{1, "a"}); err != nil {
+		t.Error("expect a comparable map key to pass, got", err)
+	}
+	if err := dataloader.CheckKey(tagsKey{[]string{"a"}}); err == nil || !strings.Contains(err.Error(), "not comparable") {
+		t.Error("expect an error for a slice map key, got", err)
+	}
+	if err := dataloader.CheckKey([2]interface{}{1, []int{2}}); err == nil {
+		t.Error("expect an error for a slice held in an interface")
+	}
+
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	})
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "MapKey of dataloader_test.tagsKey returned []string") {
+			t.Error("expect a clear panic when loading, got", r)
+		}
+	}()
+	dl.Load(tagsKey{[]string{"a"}})
+}
+
+func TestClearMany(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.LoadMany([]interface{}{userKey{1, "a"}, userKey{2, "b"}, userKey{3, "c"}})
+	dl.ClearMany([]interface{}{userKey{1, ""}, userKey{3, ""}})
+	fetched = nil
+	dl.LoadMany([]interface{}{userKey{1, "a"}, userKey{2, "b"}, userKey{3, "c"}})
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].(userKey).id < fetched[j].(userKey).id })
+	if fmt.Sprint(fetched) != "[{1 a} {3 c}]" {
+		t.Error("expect the cleared keys to be fetched again, got:", fetched)
+	}
+}
+
+func TestClearWhere(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		return make([]dataloader.Value, len(keys))
+	})
+	keys := []interface{}{"t1:a", "t2:a", "t1:b"}
+	dl.LoadMany(keys)
+	dl.ClearWhere(func(key interface{}) bool {
+		return strings.HasPrefix(key.(string), "t1:")
+	})
+	fetched = nil
+	dl.LoadMany(keys)
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].(string) < fetched[j].(string) })
+	if fmt.Sprint(fetched) != "[t1:a t1:b]" {
+		t.Error("expect the matching keys to be fetched again, got:", fetched)
+	}
+}
+
+func TestPrimeMany(t *testing.T) {
+	var fetched []interface{}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		fetched = append(fetched, keys...)
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.Prime(userKey{1, ""}, dataloader.NewValue("old", nil))
+	dl.PrimeMany(
+		[]interface{}{userKey{1, ""}, userKey{2, ""}},
+		[]dataloader.Value{dataloader.NewValue("new", nil), dataloader.NewValue("b", nil)})
+	values := dl.LoadMany([]interface{}{userKey{1, "a"}, userKey{2, "b"}})
+	if values[0].V != "old" || values[1].V != "b" || len(fetched) != 0 {
+		t.Errorf("expect primed values not to override cached ones, got %v, fetched: %v", values, fetched)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expect a panic on mismatched lengths")
+		}
+	}()
+	dl.PrimeMany([]interface{}{"a"}, nil)
+}
+
+func TestPrimeForce(t *testing.T) {
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.Prime("key", dataloader.NewValue("old", nil))
+	dl.Prime("key", dataloader.NewValue("ignored", nil))
+	if v := dl.Load("key"); v.V != "old" {
+		t.Error("expect Prime not to replace the cached value, got:", v)
+	}
+	dl.PrimeForce("key", dataloader.NewValue("new", nil))
+	if v := dl.Load("key"); v.V != "new" {
+		t.Error("expect PrimeForce to replace the cached value, got:", v)
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, newLoader := range []func(func([]interface{}) []dataloader.Value) *dataloader.DataLoader{
+		func(f func([]interface{}) []dataloader.Value) *dataloader.DataLoader { return dataloader.New(nil, f) },
+		func(f func([]interface{}) []dataloader.Value) *dataloader.DataLoader { return dataloader.NewSync(f) },
+	} {
+		dl := newLoader(func(keys []interface{}) []dataloader.Value {
+			return make([]dataloader.Value, len(keys))
+		})
+		dl.Prime("a", dataloader.NewValue("a", nil))
+		dl.LoadMany([]interface{}{"a", "b", "c"})
+		before := dl.Stats()
+		dl.LoadMany([]interface{}{"a", "b", "d"})
+		want := dataloader.Stats{Hits: 3, Misses: 3, BatchCalls: 2, KeysFetched: 3, Primes: 1}
+		if got := dl.Stats(); got != want {
+			t.Errorf("expect %+v, got %+v", want, got)
+		}
+		if diff := dl.Stats().Hits - before.Hits; diff != 2 {
+			t.Error("expect 2 hits in the second load, got", diff)
+		}
+	}
+}
+
+func TestBatchStats(t *testing.T) {
+	var batches []dataloader.BatchStats
+	opts := []dataloader.Option{dataloader.WithBatchStats(func(s dataloader.BatchStats) {
+		batches = append(batches, s)
+	})}
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	}
+	var dl *dataloader.DataLoader
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl = dataloader.New(sch, batchLoader, opts...)
+		dl.Prime("c", dataloader.NewValue("c", nil))
+		sch.Spawn(func() {
+			dl.LoadMany([]interface{}{"a", "b", "a"})
+		})
+		sch.Spawn(func() {
+			dl.LoadMany([]interface{}{"b", "c"})
+		})
+	})
+	want := "[{Requested:5 CacheHits:1 Deduped:2 Fetched:2}]"
+	if got := fmt.Sprintf("%+v", batches); got != want {
+		t.Errorf("expect %s, got %s", want, got)
+	}
+	if stats := dl.Stats(); stats.Hits != 1 || stats.Deduped != 2 || stats.KeysFetched != 2 {
+		t.Errorf("expect the cumulative counts in Stats, got %+v", stats)
+	}
+
+	batches = nil
+	dl = dataloader.NewSync(batchLoader, opts...)
+	dl.Prime("c", dataloader.NewValue("c", nil))
+	dl.LoadMany([]interface{}{"a", "b", "a", "c"})
+	want = "[{Requested:4 CacheHits:1 Deduped:1 Fetched:2}]"
+	if got := fmt.Sprintf("%+v", batches); got != want {
+		t.Errorf("sync: expect %s, got %s", want, got)
+	}
+}
+
+func TestLoadThunk(t *testing.T) {
+	var batches [][]interface{}
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		sorted := append([]interface{}(nil), keys...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].(int) < sorted[j].(int) })
+		batches = append(batches, sorted)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(key, nil)
+		}
+		return values
+	}
+	for _, withScheduler := range []bool{false, true} {
+		batches = nil
+		var got []interface{}
+		run := func(sch *dataloader.Scheduler) {
+			dl := dataloader.New(sch, batchLoader)
+			var thunks []func() dataloader.Value
+			for i := 0; i < 3; i++ {
+				thunks = append(thunks, dl.LoadThunk(i))
+			}
+			for _, thunk := range thunks {
+				got = append(got, thunk().V)
+			}
+			got = append(got, thunks[0]().V)
+		}
+		if withScheduler {
+			dataloader.RunWithScheduler(run)
+		} else {
+			run(nil)
+		}
+		if fmt.Sprint(batches) != "[[0 1 2]]" || fmt.Sprint(got) != "[0 1 2 0]" {
+			t.Errorf("scheduler %v: expect a single batch, got batches %v, values %v", withScheduler, batches, got)
+		}
+	}
+}
+
+func TestLoadThunkCtx(t *testing.T) {
+	var calls int
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			calls++
+			return []dataloader.Value{dataloader.NewValue("a", nil)}
+		})
+		cancelled := dl.LoadThunkCtx("a")
+		thunk := dl.LoadThunkCtx("a")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if v := cancelled(ctx); !errors.Is(v.Err, context.Canceled) {
+			t.Error("expect the thunk cancelled, got", v)
+		}
+		if v := thunk(context.Background()); v.V != "a" {
+			t.Error("expect the other thunk to get the value, got", v)
+		}
+		if v := cancelled(context.Background()); v.V != "a" {
+			t.Error("expect the value once forced again, got", v)
+		}
+	}, dataloader.WithDeadlockDetection())
+	if calls != 1 {
+		t.Error("expect a single fetch, got", calls)
+	}
+}
+
+func TestLoadPriority(t *testing.T) {
+	for _, high := range []bool{false, true} {
+		var events []string
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				events = append(events, fmt.Sprint("fetch ", keys))
+				return make([]dataloader.Value, len(keys))
+			})
+			sch.Spawn(func() {
+				sch.SpawnLow(func() {
+					events = append(events, "low")
+				})
+			})
+			sch.Spawn(func() { // Runs first.
+				dl.LoadPriority("a", high)
+			})
+		}, dataloader.WithDeadlockDetection())
+		want := map[bool]string{false: "[low fetch [a]]", true: "[fetch [a] low]"}[high]
+		if fmt.Sprint(events) != want {
+			t.Errorf("high %v: expect %v, got %v", high, want, events)
+		}
+	}
+}
+
+func TestBatchHook(t *testing.T) {
+	var calls []string
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		time.Sleep(time.Millisecond)
+		if keys[0] == "panic" {
+			panic("boom")
+		}
+		return []dataloader.Value{{Err: errors.New("not found")}}
+	}, dataloader.WithBatchHook(func(keys []interface{}, values []dataloader.Value, dur time.Duration) {
+		if dur < time.Millisecond {
+			t.Error("expect the duration of the call, got", dur)
+		}
+		calls = append(calls, fmt.Sprint(keys, " ", values[0].Err != nil))
+	}))
+	dl.Load("a")
+	dl.Load("panic")
+	if fmt.Sprint(calls) != "[[a] true [panic] true]" {
+		t.Error("expect the hook to be called for each batch, got:", calls)
+	}
+}
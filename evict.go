@@ -0,0 +1,65 @@
+package dataloader
+
+// EvictReason is why a value left the cache, see WithOnEvict.
+type EvictReason int
+
+const (
+	// EvictCleared is for a value removed by Clear, ClearMany or ClearWhere.
+	EvictCleared EvictReason = iota
+	// EvictClearedAll is for a value removed by ClearAll.
+	EvictClearedAll
+	// EvictExpired is for a value older than the TTL, see WithTTL.
+	EvictExpired
+	// EvictCapacity is for the least recently used value evicted from a full cache, see
+	// WithMaxSize.
+	EvictCapacity
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCleared:
+		return "cleared"
+	case EvictClearedAll:
+		return "cleared all"
+	case EvictExpired:
+		return "expired"
+	case EvictCapacity:
+		return "capacity"
+	}
+	return "unknown"
+}
+
+type eviction struct {
+	key    interface{}
+	v      Value
+	reason EvictReason
+}
+
+// evicted records the eviction of a value, for flushDeferred to report it. The caches
+// call it with their lock held, and the loader often with dl.mu locked.
+func (dl *DataLoader) evicted(key interface{}, v Value, reason EvictReason) {
+	dl.dropMeta(key)
+	if dl.onEvict == nil {
+		return
+	}
+	dl.evictMu.Lock()
+	defer dl.evictMu.Unlock()
+	dl.evictions = append(dl.evictions, eviction{key, v, reason})
+}
+
+// flushDeferred does the writes queued for a BatchCache, then calls the callback set by
+// WithOnEvict for the evictions recorded. It must be called without dl.mu locked, so
+// that the cache isn't accessed with it locked, and the callback can use the loader.
+func (dl *DataLoader) flushDeferred() {
+	dl.flushWrites()
+	if dl.onEvict == nil {
+		return
+	}
+	dl.evictMu.Lock()
+	evictions := dl.evictions
+	dl.evictions = nil
+	dl.evictMu.Unlock()
+	for _, e := range evictions {
+		dl.onEvict(e.key, e.v, e.reason)
+	}
+}
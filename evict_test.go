@@ -0,0 +1,52 @@
+package dataloader_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestOnEvict(t *testing.T) {
+	var events []string
+	var dl *dataloader.DataLoader
+	dl = dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(strings.ToUpper(key.(string)), nil)
+		}
+		return values
+	}, dataloader.WithMaxSize(2), dataloader.WithTTL(20*time.Millisecond), dataloader.WithOnEvict(
+		func(key interface{}, v dataloader.Value, reason dataloader.EvictReason) {
+			// Runs outside of the loader's locks.
+			dl.Len()
+			events = append(events, fmt.Sprintf("%v=%v %v", key, v.V, reason))
+		}))
+
+	dl.Load("a")
+	dl.Load("b")
+	dl.Load("c")
+	dl.Clear("b")
+	dl.Clear("missing")
+	dl.Load("d")
+	dl.ClearAll()
+	dl.Load("e")
+	time.Sleep(30 * time.Millisecond)
+	dl.Load("e")
+	want := []string{
+		"a=A capacity",
+		"b=B cleared",
+		"c=C cleared all",
+		"d=D cleared all",
+		"e=E expired",
+	}
+	if len(events) == len(want) {
+		sort.Strings(events[2:4]) // The order of ClearAll is unspecified.
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("expect %v, got %v", want, events)
+	}
+}
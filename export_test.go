@@ -0,0 +1,30 @@
+package dataloader
+
+// TTLEntries returns the number of expiries tracked by the cache of dl.
+func TTLEntries(dl *DataLoader) int {
+	n := 0
+	count := func(c Cache) {
+		if c, ok := c.(*ttlCache); ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			n += len(c.expires)
+		}
+	}
+	if c, ok := dl.cache.(*shardedCache); ok {
+		for _, s := range c.shards {
+			count(s)
+		}
+	} else {
+		count(dl.cache)
+	}
+	return n
+}
+
+// Locked returns whether the mu of dl is locked.
+func Locked(dl *DataLoader) bool {
+	if dl.mu.TryLock() {
+		dl.mu.Unlock()
+		return false
+	}
+	return true
+}
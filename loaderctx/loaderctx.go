@@ -0,0 +1,55 @@
+// Package loaderctx carries a per-request DataLoader in a context, for GraphQL resolvers
+// and other code reached through a context rather than through arguments.
+//
+// Middleware runs each request in its own scheduler, with a fresh loader bound to it:
+// the resolvers loading from the handler's goroutine, or from tasks spawned on the
+// scheduler, are batched together within a single GraphQL execution. Resolvers run in
+// goroutines of their own aren't known to the scheduler and must not load from it.
+package loaderctx
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bigdrum/godataloader"
+)
+
+type contextKey struct{}
+
+type loaders struct {
+	dl  *dataloader.DataLoader
+	sch *dataloader.Scheduler
+}
+
+// NewContext returns a copy of ctx carrying dl.
+func NewContext(ctx context.Context, dl *dataloader.DataLoader) context.Context {
+	return newContext(ctx, dl, nil)
+}
+
+func newContext(ctx context.Context, dl *dataloader.DataLoader, sch *dataloader.Scheduler) context.Context {
+	return context.WithValue(ctx, contextKey{}, loaders{dl: dl, sch: sch})
+}
+
+// FromContext returns the loader carried by ctx, or nil if none.
+func FromContext(ctx context.Context) *dataloader.DataLoader {
+	l, _ := ctx.Value(contextKey{}).(loaders)
+	return l.dl
+}
+
+// SchedulerFromContext returns the scheduler of the request, set by Middleware, or nil
+// if none. Resolvers spawn their concurrent work on it to have it batched.
+func SchedulerFromContext(ctx context.Context) *dataloader.Scheduler {
+	l, _ := ctx.Value(contextKey{}).(loaders)
+	return l.sch
+}
+
+// Middleware serves each request with next in a scheduler of its own, with the loader
+// created by newLoader for the scheduler in the request context. The scheduler stops
+// with the request context, see dataloader.WithSchedulerContext.
+func Middleware(newLoader func(sch *dataloader.Scheduler) *dataloader.DataLoader, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			next.ServeHTTP(w, r.WithContext(newContext(sch.Context(), newLoader(sch), sch)))
+		}, dataloader.WithSchedulerContext(r.Context()))
+	})
+}
@@ -0,0 +1,63 @@
+package loaderctx_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+	"github.com/bigdrum/godataloader/loaderctx"
+)
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if loaderctx.FromContext(ctx) != nil || loaderctx.SchedulerFromContext(ctx) != nil {
+		t.Error("expect no loader in an empty context")
+	}
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	})
+	if loaderctx.FromContext(loaderctx.NewContext(ctx, dl)) != dl {
+		t.Error("expect the loader carried by the context")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var batches [][]interface{}
+	newLoader := func(sch *dataloader.Scheduler) *dataloader.DataLoader {
+		return dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, keys)
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(key, nil)
+			}
+			return values
+		})
+	}
+	// Two fields resolved concurrently, as spawned by an executor.
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		sch := loaderctx.SchedulerFromContext(ctx)
+		for _, key := range []string{"a", "b"} {
+			key := key
+			sch.Spawn(func() {
+				fmt.Fprintln(w, loaderctx.FromContext(ctx).Load(key).V)
+			})
+		}
+	})
+	server := httptest.NewServer(loaderctx.Middleware(newLoader, handler))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 2 {
+		t.Error("expect a loader per request, batching its fields, got", batches)
+	}
+}
@@ -0,0 +1,34 @@
+package dataloader
+
+// LoaderSet creates sibling loaders, e.g. one per entity type, sharing a scheduler and
+// a set of options, each with its own cache and batchLoader. The loaders are registered
+// by name, so that the set also serves their metrics, see Registry.
+type LoaderSet struct {
+	*Registry
+	sch  *Scheduler
+	opts []Option
+}
+
+// NewLoaderSet creates an empty set of loaders using sch, configured with opts. The
+// options are applied to each loader, before its own: an option holding a value, like
+// WithCache, would share it between the loaders, and belongs to Add instead.
+func NewLoaderSet(sch *Scheduler, opts ...Option) *LoaderSet {
+	return &LoaderSet{Registry: NewRegistry(), sch: sch, opts: opts}
+}
+
+// Add creates a loader of the set under name, replacing any loader with the same name,
+// and returns it. The loader is configured with the options of the set, then opts.
+func (s *LoaderSet) Add(name string, batchLoader func(keys []interface{}) []Value, opts ...Option) *DataLoader {
+	all := make([]Option, 0, len(s.opts)+len(opts))
+	all = append(append(all, s.opts...), opts...)
+	dl := New(s.sch, batchLoader, all...)
+	s.Register(name, dl)
+	return dl
+}
+
+// ClearAll clears the caches of all the loaders of the set, see DataLoader.ClearAll.
+func (s *LoaderSet) ClearAll() {
+	s.each(func(name string, dl *DataLoader) {
+		dl.ClearAll()
+	})
+}
@@ -0,0 +1,53 @@
+package dataloader_test
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestLoaderSet(t *testing.T) {
+	var batches []string
+	batchLoader := func(kind string) func(keys []interface{}) []dataloader.Value {
+		return func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, fmt.Sprint(kind, len(keys)))
+			values := make([]dataloader.Value, len(keys))
+			for i, key := range keys {
+				values[i] = dataloader.NewValue(fmt.Sprint(kind, key), nil)
+			}
+			return values
+		}
+	}
+	var set *dataloader.LoaderSet
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		set = dataloader.NewLoaderSet(sch, dataloader.WithMaxBatchSize(2))
+		set.Add("users", batchLoader("user"))
+		set.Add("posts", batchLoader("post"), dataloader.WithMaxBatchSize(3))
+		for _, key := range []int{1, 2, 3} {
+			key := key
+			sch.Spawn(func() {
+				if v := set.Loader("users").Load(key); v.V != fmt.Sprint("user", key) {
+					t.Error("unexpected user:", v)
+				}
+			})
+			sch.Spawn(func() {
+				if v := set.Loader("posts").Load(key); v.V != fmt.Sprint("post", key) {
+					t.Error("unexpected post:", v)
+				}
+			})
+		}
+	})
+	sort.Strings(batches)
+	if got := fmt.Sprint(batches); got != "[post3 user1 user2]" {
+		t.Error("expect the options of the set, overridden by the ones of the loader, got", got)
+	}
+	if set.Loader("users").Len() != 3 || set.Loader("comments") != nil {
+		t.Error("expect independent caches by name")
+	}
+	set.ClearAll()
+	if set.Loader("users").Len() != 0 || set.Loader("posts").Len() != 0 {
+		t.Error("expect ClearAll to clear all the loaders")
+	}
+}
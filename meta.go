@@ -0,0 +1,91 @@
+package dataloader
+
+import (
+	"context"
+	"time"
+)
+
+// Meta describes how a value was loaded, see LoadWithMeta.
+type Meta struct {
+	// FetchedAt is when the value was fetched, or primed.
+	FetchedAt time.Time
+	// BatchDuration is how long the batch took to fetch the value, retries included.
+	// It is zero for primed values.
+	BatchDuration time.Duration
+}
+
+// LoadWithMeta is like Load, and also returns the Meta of the value, e.g. to tell
+// whether it is stale. It requires WithMeta, otherwise the Meta is always zero, as it
+// is when unknown: for values merged or restored from another loader, or fetched by a
+// sync loader but not cached.
+func (dl *DataLoader) LoadWithMeta(key interface{}) (Value, Meta) {
+	if dl.metas == nil || dl.sync {
+		v := dl.Load(key)
+		return v, dl.metaOf(dl.mapKey(key))
+	}
+	keys := []interface{}{key}
+	values, mkeys, missing := dl.lookup(keys)
+	if len(missing) == 0 {
+		return values[0], dl.metaOf(mkeys[0])
+	}
+	ctx := context.Background()
+	batches := dl.enqueue(keys, mkeys, missing, values, loadCached)
+	if err := dl.wait(ctx, batches, mkeys); err != nil {
+		return cancelledValue(err), Meta{}
+	}
+	b := batches[0]
+	if b == nil {
+		// Cached in between.
+		return values[0], dl.metaOf(mkeys[0])
+	}
+	if b.perKey {
+		dl.mu.RLock()
+		defer dl.mu.RUnlock()
+	}
+	v, ok := b.meta[mkeys[0]]
+	if !ok {
+		// Served from the cache at dispatch, or primed.
+		return b.values[mkeys[0]], dl.metaOf(mkeys[0])
+	}
+	return b.values[mkeys[0]], v
+}
+
+// fetchedMeta records the Meta of the value of mkey fetched by b, and of the cached one
+// if cached.
+//
+// Must be called with dl.mu locked.
+func (dl *DataLoader) fetchedMeta(b *batch, mkey interface{}, cached bool) {
+	now := time.Now()
+	m := Meta{FetchedAt: now, BatchDuration: now.Sub(b.started)}
+	if b.meta == nil {
+		b.meta = make(map[interface{}]Meta)
+	}
+	b.meta[mkey] = m
+	if cached {
+		dl.setMeta(mkey, m)
+	}
+}
+
+func (dl *DataLoader) setMeta(mkey interface{}, m Meta) {
+	dl.metaMu.Lock()
+	defer dl.metaMu.Unlock()
+	dl.metas[mkey] = m
+}
+
+func (dl *DataLoader) dropMeta(mkey interface{}) {
+	if dl.metas == nil {
+		return
+	}
+	dl.metaMu.Lock()
+	defer dl.metaMu.Unlock()
+	delete(dl.metas, mkey)
+}
+
+func (dl *DataLoader) metaOf(mkey interface{}) Meta {
+	if dl.metas == nil {
+		return Meta{}
+	}
+	dl.metaMu.Lock()
+	defer dl.metaMu.Unlock()
+	return dl.metas[mkey]
+}
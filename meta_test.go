@@ -0,0 +1,37 @@
+package dataloader_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestLoadWithMeta(t *testing.T) {
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		time.Sleep(5 * time.Millisecond)
+		return make([]dataloader.Value, len(keys))
+	}
+	for _, dl := range []*dataloader.DataLoader{
+		dataloader.New(nil, batchLoader, dataloader.WithMeta()),
+		dataloader.NewSync(batchLoader, dataloader.WithMeta()),
+	} {
+		start := time.Now()
+		_, fetched := dl.LoadWithMeta("a")
+		if fetched.FetchedAt.Before(start) || fetched.BatchDuration < 5*time.Millisecond {
+			t.Errorf("unexpected meta of a fetched value: %+v", fetched)
+		}
+		if _, cached := dl.LoadWithMeta("a"); cached != fetched {
+			t.Errorf("expect the meta of the cached value, got %+v, want %+v", cached, fetched)
+		}
+		dl.Prime("b", dataloader.NewValue("b", nil))
+		if _, primed := dl.LoadWithMeta("b"); primed.FetchedAt.IsZero() || primed.BatchDuration != 0 {
+			t.Errorf("unexpected meta of a primed value: %+v", primed)
+		}
+	}
+
+	dl := dataloader.New(nil, batchLoader)
+	if _, meta := dl.LoadWithMeta("a"); meta != (dataloader.Meta{}) {
+		t.Error("expect no meta without WithMeta, got", meta)
+	}
+}
@@ -0,0 +1,84 @@
+package dataloader
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Loader is the loading side of a DataLoader, which middlewares decorate.
+type Loader interface {
+	Load(key interface{}) Value
+	LoadMany(keys []interface{}) []Value
+}
+
+// Middleware decorates a Loader, for logging, metrics, retries and so on.
+type Middleware func(next Loader) Loader
+
+// Chain composes middlewares into one. The first middleware is the outermost: it sees
+// the loads first and the values last.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Loader) Loader {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// LoadManyFunc adapts a function to Loader, Load being a LoadMany of a single key. It
+// makes middlewares easy to write.
+type LoadManyFunc func(keys []interface{}) []Value
+
+// Load loads a single value.
+func (f LoadManyFunc) Load(key interface{}) Value {
+	return f([]interface{}{key})[0]
+}
+
+// LoadMany loads multiple values.
+func (f LoadManyFunc) LoadMany(keys []interface{}) []Value {
+	return f(keys)
+}
+
+// Logging is a middleware logging each load, with its keys, duration and the number of
+// errors, through logf.
+func Logging(logf func(format string, args ...interface{})) Middleware {
+	return func(next Loader) Loader {
+		return LoadManyFunc(func(keys []interface{}) []Value {
+			start := time.Now()
+			values := next.LoadMany(keys)
+			errs := 0
+			for _, v := range values {
+				if v.Err != nil {
+					errs++
+				}
+			}
+			logf("dataloader: loaded %v in %v, %d errors", keys, time.Since(start), errs)
+			return values
+		})
+	}
+}
+
+// LoadCounts holds the counters updated by the Counting middleware. Read them with
+// sync/atomic.
+type LoadCounts struct {
+	Calls  uint64
+	Keys   uint64
+	Errors uint64
+}
+
+// Counting is a middleware counting the loads, the loaded keys and the errors in c.
+func Counting(c *LoadCounts) Middleware {
+	return func(next Loader) Loader {
+		return LoadManyFunc(func(keys []interface{}) []Value {
+			values := next.LoadMany(keys)
+			atomic.AddUint64(&c.Calls, 1)
+			atomic.AddUint64(&c.Keys, uint64(len(keys)))
+			for _, v := range values {
+				if v.Err != nil {
+					atomic.AddUint64(&c.Errors, 1)
+				}
+			}
+			return values
+		})
+	}
+}
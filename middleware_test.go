@@ -0,0 +1,56 @@
+package dataloader_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func tracing(name string, events *[]string) dataloader.Middleware {
+	return func(next dataloader.Loader) dataloader.Loader {
+		return dataloader.LoadManyFunc(func(keys []interface{}) []dataloader.Value {
+			*events = append(*events, name+" before")
+			values := next.LoadMany(keys)
+			*events = append(*events, name+" after")
+			return values
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	dl := dataloader.New(nil, dataloader.Serial(func(key interface{}) dataloader.Value {
+		if key == "bad" {
+			return dataloader.NewValue(nil, errors.New("bad key"))
+		}
+		return dataloader.NewValue(key, nil)
+	}))
+
+	var events []string
+	var logs []string
+	var counts dataloader.LoadCounts
+	l := dataloader.Chain(
+		tracing("outer", &events),
+		tracing("inner", &events),
+		dataloader.Counting(&counts),
+		dataloader.Logging(func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		}),
+	)(dl)
+
+	if v := l.Load("a"); v.V != "a" {
+		t.Error("unexpected value:", v)
+	}
+	if fmt.Sprint(events) != "[outer before inner before inner after outer after]" {
+		t.Error("unexpected order:", events)
+	}
+	l.LoadMany([]interface{}{"b", "bad"})
+	if counts != (dataloader.LoadCounts{Calls: 2, Keys: 3, Errors: 1}) {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+	if len(logs) != 2 || !strings.Contains(logs[1], "[b bad]") || !strings.Contains(logs[1], "1 errors") {
+		t.Error("unexpected logs:", logs)
+	}
+}
@@ -0,0 +1,302 @@
+package dataloader
+
+import "time"
+
+// Option configures a DataLoader, see New.
+type Option func(*DataLoader)
+
+// WithInitialCacheCap sizes the cache for n entries upfront, to avoid growing it
+// repeatedly in loaders known to hold many keys. It is also used when ClearAll
+// recreates the cache.
+func WithInitialCacheCap(n int) Option {
+	return func(dl *DataLoader) {
+		dl.cacheCap = n
+	}
+}
+
+// WithInitialPendingCap sizes the set of keys waiting for the next batch for n keys.
+func WithInitialPendingCap(n int) Option {
+	return func(dl *DataLoader) {
+		dl.pendingCap = n
+	}
+}
+
+// WithInitialCapacity is a hint that the loader will hold about n keys: it combines
+// WithInitialCacheCap and WithInitialPendingCap. The cache and the batches still grow
+// past n as needed.
+func WithInitialCapacity(n int) Option {
+	return func(dl *DataLoader) {
+		WithInitialCacheCap(n)(dl)
+		WithInitialPendingCap(n)(dl)
+	}
+}
+
+// WithOnPending sets a hook called when a key starts waiting for a fetch, once per
+// fetch of the key. It is called without holding the loader's lock, so it may use
+// the loader.
+func WithOnPending(f func(key interface{})) Option {
+	return func(dl *DataLoader) {
+		dl.onPending = f
+	}
+}
+
+// WithOnFetched sets a hook called for each fetched value, cached or not: the errors
+// not cached, see WithCacheErrors, the values of keys invalidated while being fetched,
+// and those loaded with LoadOnce or WithoutCache are passed too. Like WithOnPending, it
+// is called without holding the loader's lock.
+func WithOnFetched(f func(key interface{}, v Value)) Option {
+	return func(dl *DataLoader) {
+		dl.onFetched = f
+	}
+}
+
+// WithRetry makes the loader fetch again the keys whose value is an error, other than
+// ErrNotFound, up to attempts times, before handing the error to the loads. Before the
+// n-th retry, it waits for backoff(n), if backoff is not nil, or for the RetryAfter
+// hint of the errors if longer. The loads of a key share its retries, which run within
+// the fetch, and wait cooperatively when there is a scheduler.
+func WithRetry(attempts int, backoff func(attempt int) time.Duration) Option {
+	return func(dl *DataLoader) {
+		dl.retries = attempts
+		dl.retryBackoff = backoff
+	}
+}
+
+// WithOnEvict sets a callback called when values leave the cache, with their map key
+// and why, e.g. to release the resources they hold. It isn't called for the values
+// replaced by PrimeForce, nor consumed by LoadAndDelete, nor evicted by a cache set
+// with WithCache. It runs after the loader has released its locks, so it may use the
+// loader, but possibly on another goroutine than the one evicting, and shortly after.
+func WithOnEvict(f func(key interface{}, v Value, reason EvictReason)) Option {
+	return func(dl *DataLoader) {
+		dl.onEvict = f
+	}
+}
+
+// WithBatchHook sets a hook called after each call to the batchLoader, with the keys
+// passed, the values returned, errors included, and the time the call took. With
+// WithMaxBatchSize, it is called for each chunk. It is meant for exporting batch sizes
+// and latencies.
+func WithBatchHook(f func(keys []interface{}, values []Value, dur time.Duration)) Option {
+	return func(dl *DataLoader) {
+		dl.batchHook = f
+	}
+}
+
+// WithBatchStats sets a function called with the BatchStats of each batch, when it is
+// fetched, to tell whether the loads actually batch. The Stats of the loader count the
+// same cumulatively: Hits, Deduped and KeysFetched.
+func WithBatchStats(f func(s BatchStats)) Option {
+	return func(dl *DataLoader) {
+		dl.onBatchStats = f
+	}
+}
+
+// WithTracer makes the loader trace its work with t:
+//   - a "dataloader.batch" span around each fetch, child of the scheduler context, with
+//     the number of keys fetched and found in the cache as attributes,
+//   - a "dataloader.load" span around LoadCtx and LoadManyCtx, child of their context,
+//     ending when the values are loaded.
+func WithTracer(t Tracer) Option {
+	return func(dl *DataLoader) {
+		dl.tracer = t
+	}
+}
+
+// WithShardedCache makes the loader use a cache split into n shards, each with its own
+// lock, to reduce contention when many goroutines read the cache concurrently.
+func WithShardedCache(n int) Option {
+	return func(dl *DataLoader) {
+		dl.shards = n
+	}
+}
+
+// PrimePrecedence decides which value wins when a key waiting for a fetch is primed.
+type PrimePrecedence int
+
+const (
+	// PrimeWins keeps the primed value, which is given to the loads waiting for the
+	// key, like Prime never overwrites a cached value. The key isn't fetched if it is
+	// primed before the fetch starts. This is the default.
+	PrimeWins PrimePrecedence = iota
+	// FetchWins fetches the key anyway, and the fetched value replaces the primed one.
+	FetchWins
+)
+
+// WithPrimePrecedence sets which value wins when a key waiting for a fetch is primed.
+func WithPrimePrecedence(p PrimePrecedence) Option {
+	return func(dl *DataLoader) {
+		dl.primePrecedence = p
+	}
+}
+
+// DropPolicy decides which key is dropped when a bounded queue is full.
+type DropPolicy int
+
+const (
+	// DropNewest drops the key being added. This is the default.
+	DropNewest DropPolicy = iota
+	// DropOldest drops the key queued first to make room for the new one.
+	DropOldest
+)
+
+// WithPrefetchQueue bounds the number of prefetched keys waiting for the next fetch to
+// max, dropping the keys in excess according to policy, to keep opportunistic warming
+// from overwhelming the backend. See Prefetch and PrefetchDropped.
+func WithPrefetchQueue(max int, policy DropPolicy) Option {
+	return func(dl *DataLoader) {
+		dl.prefetchMax = max
+		dl.prefetchPolicy = policy
+	}
+}
+
+// WithTTL makes cached values expire d after they are fetched or primed. Loads of
+// expired keys fetch them again, concurrent ones still sharing a single fetch. With
+// WithShardedCache, each shard keeps the expiries of its values behind its own lock.
+func WithTTL(d time.Duration) Option {
+	return func(dl *DataLoader) {
+		dl.ttl = d
+	}
+}
+
+// WithMaxSize caps the number of cached values to n, evicting the least recently
+// loaded ones. Fetches in flight are unaffected by evictions: their waiters get the
+// fetched values regardless. With WithShardedCache, each shard holds an equal part of
+// n.
+func WithMaxSize(n int) Option {
+	return func(dl *DataLoader) {
+		dl.maxSize = n
+	}
+}
+
+// WithMaxCost caps the total cost of the cached values to total, cost giving the cost
+// of each value, e.g. its size in bytes, evicting the least recently loaded ones until
+// under the budget. A value costing more than total on its own isn't kept. It combines
+// with WithMaxSize, whichever limit is exceeded evicting. With WithShardedCache, each
+// shard holds an equal part of total.
+func WithMaxCost(total int64, cost func(v Value) int64) Option {
+	return func(dl *DataLoader) {
+		dl.maxCost = total
+		dl.cost = cost
+	}
+}
+
+// WithCacheErrors sets whether values with a non-nil Err are cached like any other.
+// By default they are not, so a key whose fetch failed is fetched again on its next
+// load. ErrNotFound is always cached.
+func WithCacheErrors(cacheErrors bool) Option {
+	return func(dl *DataLoader) {
+		dl.cacheErrors = cacheErrors
+	}
+}
+
+// WithKeyFunc sets the function mapping the keys to their map keys, identifying them
+// in the cache and in the batches, in place of MapKeyer: e.g. to lowercase strings, or
+// to round timestamps. Keys with the same map key are fetched once, the batchLoader
+// getting one of the original keys. The function must return comparable values.
+func WithKeyFunc(f func(key interface{}) interface{}) Option {
+	return func(dl *DataLoader) {
+		dl.keyFunc = f
+	}
+}
+
+// WithKeyHasher is like WithKeyFunc, with h hashing the keys to strings, e.g. to key
+// on structs holding slices or maps, which can't be map keys themselves. Keys with the
+// same hash are the same key: h must be deterministic, and as discriminating as the
+// backend. With NewWithMap, the map returned is indexed by hash.
+func WithKeyHasher(h func(key interface{}) string) Option {
+	return WithKeyFunc(func(key interface{}) interface{} {
+		return h(key)
+	})
+}
+
+// WithMeta makes the loader keep the Meta of the cached values, for LoadWithMeta.
+func WithMeta() Option {
+	return func(dl *DataLoader) {
+		dl.withMeta = true
+	}
+}
+
+// WithEagerFetch makes the fetches run with normal priority in the scheduler, rather
+// than once all the other tasks wait: the fetch of a batch may then start while other
+// tasks would still have added keys to it, trading batching for latency.
+func WithEagerFetch() Option {
+	return func(dl *DataLoader) {
+		dl.eagerFetch = true
+	}
+}
+
+// WithPerKeyNotify serves the loads waiting for a key as soon as its value is known,
+// rather than once the whole batch is: after each chunk with WithMaxBatchSize, and
+// before retrying the failed keys with WithRetry. By default, all the loads waiting for
+// a batch are woken up together, which is cheaper.
+func WithPerKeyNotify() Option {
+	return func(dl *DataLoader) {
+		dl.perKey = true
+	}
+}
+
+// WithBatchWindow delays the fetch of a batch until d after its first key, so that
+// the loads from concurrent goroutines meanwhile join it. It is mostly useful without a
+// scheduler, where the first load waiting fetches right away otherwise. With one, the
+// fetch waits cooperatively. It is off by default, and has no effect with NewSync.
+func WithBatchWindow(d time.Duration) Option {
+	return func(dl *DataLoader) {
+		dl.batchWindow = d
+	}
+}
+
+// WithMinBatchSize delays the fetch of a batch until it has n keys, or for at most
+// maxWait after its first key, for backends much more efficient with large batches.
+// Like with WithBatchWindow, the loads meanwhile join the batch, and the fetch waits
+// cooperatively with a scheduler.
+func WithMinBatchSize(n int, maxWait time.Duration) Option {
+	return func(dl *DataLoader) {
+		dl.minBatchSize = n
+		dl.minBatchWait = maxWait
+	}
+}
+
+// WithBatchTimeout sets a timeout to each call to the batchLoader, through the context
+// passed by NewCtx. The batchLoader must honor it: once it returns, all the keys get an
+// error wrapping context.DeadlineExceeded if the timeout expired.
+func WithBatchTimeout(d time.Duration) Option {
+	return func(dl *DataLoader) {
+		dl.batchTimeout = d
+	}
+}
+
+// WithMaxBatchSize limits the number of keys passed to a single batchLoader call to n.
+// Larger batches are split into chunks of at most n keys, fetched one after the other.
+func WithMaxBatchSize(n int) Option {
+	return func(dl *DataLoader) {
+		dl.maxBatchSize = n
+	}
+}
+
+// WithCache makes the loader store its values in c, e.g. a cache shared with other
+// processes, instead of the default map. WithInitialCacheCap, WithShardedCache,
+// WithMaxSize and WithMaxCost, which configure the default cache, are then ignored.
+// A remote cache should be a BatchCache, which expires its values itself: WithTTL
+// and PrimeWithTTL don't apply to it.
+func WithCache(c Cache) Option {
+	return func(dl *DataLoader) {
+		dl.cache = c
+	}
+}
+
+// WithoutCache makes the loader keep no value once fetched: loads of the same keys are
+// still batched and share the fetches in flight, but later loads fetch again. It keeps
+// the memory flat for loaders used over many distinct keys.
+func WithoutCache() Option {
+	return WithCache(noCache{})
+}
+
+// WithBatcher makes the loader dispatch its batches along with the other loaders of bt,
+// which must share its scheduler. It has no effect without a scheduler, or with
+// WithEagerFetch.
+func WithBatcher(bt *Batcher) Option {
+	return func(dl *DataLoader) {
+		dl.batcher = bt
+	}
+}
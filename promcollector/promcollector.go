@@ -0,0 +1,230 @@
+// Package promcollector exports the metrics of loaders to Prometheus: those of a
+// dataloader.Registry, e.g. the cache hits and misses and the batch calls, and
+// histograms of the batch sizes and latencies from a batch hook, labelled by loader
+// name.
+//
+// Collector is a prometheus.Collector, to register with the Prometheus client library:
+//
+//	c := promcollector.New()
+//	prometheus.MustRegister(c)
+//	c.Add("users", dataloader.New(nil, batchLoader, dataloader.WithBatchHook(c.BatchHook("users"))))
+//
+// The package is a module of its own, so that the dataloader module doesn't depend on
+// the client library.
+package promcollector
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects the metrics of a set of loaders, as a prometheus.Collector.
+type Collector struct {
+	namespace      string
+	loaderLabel    string
+	constLabels    map[string]string
+	sizeBuckets    []float64
+	latencyBuckets []float64
+	registry       *dataloader.Registry
+
+	// descs are the descriptions of the metrics, by name without namespace, set by New.
+	descs map[string]*prometheus.Desc
+
+	mu      sync.Mutex
+	loaders map[string]*loader
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// The histograms, exported after the metrics of the registry.
+var histograms = []struct {
+	name, help string
+	get        func(l *loader) *histogram
+}{
+	{"batch_size", "Number of keys passed to the batch function per call.", func(l *loader) *histogram { return &l.size }},
+	{"batch_duration_seconds", "Time the calls to the batch function took.", func(l *loader) *histogram { return &l.latency }},
+}
+
+// loader holds the histograms of a loader.
+type loader struct {
+	size    histogram
+	latency histogram
+}
+
+// Option configures a Collector.
+type Option func(*Collector)
+
+// WithNamespace sets the prefix of the metric names, "dataloader" by default.
+func WithNamespace(namespace string) Option {
+	return func(c *Collector) {
+		c.namespace = namespace
+	}
+}
+
+// WithLoaderLabel sets the name of the label holding the loader name, "loader" by
+// default.
+func WithLoaderLabel(name string) Option {
+	return func(c *Collector) {
+		c.loaderLabel = name
+	}
+}
+
+// WithConstLabels adds labels with fixed values to all the metrics, e.g. the service.
+func WithConstLabels(labels map[string]string) Option {
+	return func(c *Collector) {
+		c.constLabels = labels
+	}
+}
+
+// WithSizeBuckets sets the upper bounds of the buckets of the batch size histogram, in
+// increasing order.
+func WithSizeBuckets(buckets ...float64) Option {
+	return func(c *Collector) {
+		c.sizeBuckets = buckets
+	}
+}
+
+// WithLatencyBuckets sets the upper bounds of the buckets of the batch latency
+// histogram, in seconds, in increasing order.
+func WithLatencyBuckets(buckets ...float64) Option {
+	return func(c *Collector) {
+		c.latencyBuckets = buckets
+	}
+}
+
+// WithRegistry sets the registry whose loaders are exported, a new empty one by
+// default. Add registers the loaders in it.
+func WithRegistry(r *dataloader.Registry) Option {
+	return func(c *Collector) {
+		c.registry = r
+	}
+}
+
+// New creates a Collector.
+func New(opts ...Option) *Collector {
+	c := &Collector{
+		namespace:      "dataloader",
+		loaderLabel:    "loader",
+		sizeBuckets:    []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		latencyBuckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		loaders:        make(map[string]*loader),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.registry == nil {
+		c.registry = dataloader.NewRegistry()
+	}
+	c.descs = make(map[string]*prometheus.Desc)
+	labels := []string{c.loaderLabel}
+	c.registry.Describe(func(s dataloader.Sample) {
+		c.descs[s.Name] = prometheus.NewDesc(c.name(s.Name), s.Help, labels, c.constLabels)
+	})
+	for _, h := range histograms {
+		c.descs[h.name] = prometheus.NewDesc(c.name(h.name), h.help, labels, c.constLabels)
+	}
+	return c
+}
+
+// loader returns the histograms of the loader named name, creating them if needed.
+//
+// Must be called with c.mu locked.
+func (c *Collector) loader(name string) *loader {
+	l, ok := c.loaders[name]
+	if !ok {
+		l = &loader{size: newHistogram(c.sizeBuckets), latency: newHistogram(c.latencyBuckets)}
+		c.loaders[name] = l
+	}
+	return l
+}
+
+// Add exports the metrics of dl under name, replacing any loader with the same name,
+// see Registry.Register.
+func (c *Collector) Add(name string, dl *dataloader.DataLoader) {
+	c.registry.Register(name, dl)
+}
+
+// BatchHook returns a hook recording the batch sizes and latencies of the loader named
+// name, to set with dataloader.WithBatchHook. The histograms are exported for the
+// loaders with a hook only, registered or not.
+func (c *Collector) BatchHook(name string) func(keys []interface{}, values []dataloader.Value, dur time.Duration) {
+	c.mu.Lock()
+	l := c.loader(name)
+	c.mu.Unlock()
+	return func(keys []interface{}, values []dataloader.Value, dur time.Duration) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		l.size.observe(float64(len(keys)))
+		l.latency.observe(dur.Seconds())
+	}
+}
+
+// Describe sends the descriptions of the metrics, see prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect sends the metrics of each loader, those of the registry then the histograms,
+// see prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.registry.Collect(func(s dataloader.Sample) {
+		typ := prometheus.CounterValue
+		if s.Type == "gauge" {
+			typ = prometheus.GaugeValue
+		}
+		ch <- prometheus.MustNewConstMetric(c.descs[s.Name], typ, s.Value, s.Loader)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.loaders))
+	for name := range c.loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, h := range histograms {
+		for _, name := range names {
+			hist := h.get(c.loaders[name])
+			ch <- prometheus.MustNewConstHistogram(c.descs[h.name], hist.count, hist.sum, hist.cumulative(), name)
+		}
+	}
+}
+
+func (c *Collector) name(name string) string {
+	return prometheus.BuildFQName(c.namespace, "", name)
+}
+
+// histogram counts observations by bucket.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // Per bucket, not cumulative.
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+}
+
+func (h *histogram) cumulative() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(h.bounds))
+	var n uint64
+	for i, bound := range h.bounds {
+		n += h.counts[i]
+		buckets[bound] = n
+	}
+	return buckets
+}
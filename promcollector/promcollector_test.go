@@ -0,0 +1,95 @@
+package promcollector_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+	"github.com/bigdrum/godataloader/promcollector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// render registers c in a registry checking its descriptions, and returns the metrics
+// in the text format.
+func render(t *testing.T, c *promcollector.Collector) string {
+	t.Helper()
+	r := prometheus.NewPedanticRegistry()
+	r.MustRegister(c)
+	w := httptest.NewRecorder()
+	promhttp.HandlerFor(r, promhttp.HandlerOpts{ErrorHandling: promhttp.PanicOnError}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestCollector(t *testing.T) {
+	c := promcollector.New(
+		promcollector.WithNamespace("app"),
+		promcollector.WithLoaderLabel("name"),
+		promcollector.WithConstLabels(map[string]string{"service": "api"}),
+		promcollector.WithSizeBuckets(1, 10),
+		promcollector.WithLatencyBuckets(60),
+	)
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	}, dataloader.WithBatchHook(c.BatchHook("users")))
+	c.Add("users", dl)
+	dl.LoadMany([]interface{}{1, 2})
+	dl.Load(1)
+
+	got := render(t, c)
+	for _, want := range []string{
+		"# TYPE app_cache_entries gauge\n",
+		`app_cache_entries{name="users",service="api"} 2` + "\n",
+		"# TYPE app_cache_hits_total counter\n",
+		`app_cache_hits_total{name="users",service="api"} 1` + "\n",
+		`app_cache_misses_total{name="users",service="api"} 2` + "\n",
+		`app_batch_calls_total{name="users",service="api"} 1` + "\n",
+		"# TYPE app_batch_size histogram\n",
+		`app_batch_size_bucket{name="users",service="api",le="1"} 0` + "\n",
+		`app_batch_size_bucket{name="users",service="api",le="10"} 1` + "\n",
+		`app_batch_size_bucket{name="users",service="api",le="+Inf"} 1` + "\n",
+		`app_batch_size_sum{name="users",service="api"} 2` + "\n",
+		`app_batch_duration_seconds_bucket{name="users",service="api",le="60"} 1` + "\n",
+		`app_batch_duration_seconds_count{name="users",service="api"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expect %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestWithRegistry(t *testing.T) {
+	r := dataloader.NewRegistry()
+	r.Register("users", dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	}))
+	c := promcollector.New(promcollector.WithRegistry(r))
+	got := render(t, c)
+	if want := `dataloader_batch_calls_total{loader="users"} 0` + "\n"; !strings.Contains(got, want) {
+		t.Errorf("expect %q in:\n%s", want, got)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	c := promcollector.New()
+	hook := c.BatchHook("a")
+	hook(make([]interface{}, 3), nil, time.Millisecond)
+	hook(make([]interface{}, 30), nil, time.Millisecond)
+	got := render(t, c)
+	for _, want := range []string{
+		`dataloader_batch_size_bucket{loader="a",le="5"} 1` + "\n",
+		`dataloader_batch_size_bucket{loader="a",le="50"} 2` + "\n",
+		`dataloader_batch_size_sum{loader="a"} 33` + "\n",
+		`dataloader_batch_size_count{loader="a"} 2` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expect %q in:\n%s", want, got)
+		}
+	}
+	// Only the histograms, the loader not being added.
+	if strings.Contains(got, "dataloader_cache_hits_total{") {
+		t.Error("expect no metric of the registry, got:\n", got)
+	}
+}
@@ -0,0 +1,366 @@
+// Package rediscache provides a dataloader.Cache backed by Redis, sharing the loaded
+// values between the processes of a deployment. The loaders still deduplicate the
+// fetches in flight per process.
+//
+// The package doesn't depend on a Redis client: Client is adapted from the one in use,
+// e.g. github.com/redis/go-redis.
+package rediscache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+)
+
+// Client is the subset of Redis commands used by the cache.
+type Client interface {
+	// MGet returns the values of keys, nil for the ones that don't exist.
+	MGet(ctx context.Context, keys ...string) ([][]byte, error)
+	// SetMany sets each of keys to the data at the same position, expiring after ttl,
+	// or never if ttl is 0, e.g. with a pipeline of SET commands.
+	SetMany(ctx context.Context, keys []string, data [][]byte, ttl time.Duration) error
+	Del(ctx context.Context, keys ...string) error
+	// Scan returns some of the keys matching the glob-style pattern, from cursor, 0 to
+	// start, and the cursor to continue from, 0 once done, like SCAN.
+	Scan(ctx context.Context, cursor uint64, match string, count int64) (keys []string, next uint64, err error)
+}
+
+// Codec serializes the keys and values. The keys are map keys, see dataloader.MapKeyer:
+// EncodeKey must be deterministic, and DecodeKey must return a value equal to the
+// encoded key, e.g. of the same numeric type. The values are the Value.V stored, and
+// are shared with processes possibly running another version of the code, so their
+// encoding should be stable.
+type Codec interface {
+	EncodeKey(key interface{}) (string, error)
+	DecodeKey(s string) (interface{}, error)
+	EncodeValue(v interface{}) ([]byte, error)
+	DecodeValue(data []byte) (interface{}, error)
+}
+
+// JSONCodec encodes keys of type K and values of type V in JSON.
+type JSONCodec[K comparable, V any] struct{}
+
+func (JSONCodec[K, V]) EncodeKey(key interface{}) (string, error) {
+	k, ok := key.(K)
+	if !ok {
+		return "", fmt.Errorf("rediscache: key %v is a %T, not a %T", key, key, k)
+	}
+	data, err := json.Marshal(k)
+	return string(data), err
+}
+
+func (JSONCodec[K, V]) DecodeKey(s string) (interface{}, error) {
+	var k K
+	err := json.Unmarshal([]byte(s), &k)
+	return k, err
+}
+
+func (JSONCodec[K, V]) EncodeValue(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[K, V]) DecodeValue(data []byte) (interface{}, error) {
+	var v V
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// RedisCache is a dataloader.Cache storing the values in Redis, under a prefix. It is a
+// dataloader.BatchCache: the loaders read and write the keys of each load and fetch
+// with a single command, without holding their lock.
+//
+// Only the values without error, and dataloader.ErrNotFound, are stored: the other
+// errors aren't shared, even with dataloader.WithCacheErrors. Redis errors, and values
+// failing to decode, count as misses, the keys being fetched again, and the values
+// failing to encode aren't stored; see WithOnError to report them.
+type RedisCache struct {
+	client  Client
+	codec   Codec
+	prefix  string
+	ttl     time.Duration
+	timeout time.Duration
+	onError func(err error)
+}
+
+// Option configures a RedisCache.
+type Option func(*RedisCache)
+
+// WithPrefix sets the prefix of the Redis keys, "dataloader:" by default. Loaders
+// sharing a Redis database need distinct prefixes.
+func WithPrefix(prefix string) Option {
+	return func(c *RedisCache) {
+		c.prefix = prefix
+	}
+}
+
+// WithTTL makes the values expire from Redis after ttl.
+func WithTTL(ttl time.Duration) Option {
+	return func(c *RedisCache) {
+		c.ttl = ttl
+	}
+}
+
+// WithTimeout bounds each Redis command, 1 second by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *RedisCache) {
+		c.timeout = timeout
+	}
+}
+
+// WithOnError sets a function called with the errors of the cache, which otherwise
+// degrade silently into misses.
+func WithOnError(f func(err error)) Option {
+	return func(c *RedisCache) {
+		c.onError = f
+	}
+}
+
+// New creates a cache storing the values in Redis through client, for
+// dataloader.WithCache.
+func New(client Client, codec Codec, opts ...Option) *RedisCache {
+	c := &RedisCache{
+		client:  client,
+		codec:   codec,
+		prefix:  "dataloader:",
+		timeout: time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+var _ dataloader.BatchCache = (*RedisCache)(nil)
+
+// scanCount is the number of keys scanned per SCAN command.
+const scanCount = 1000
+
+// The first byte of the stored data tells the kind of value.
+const (
+	kindValue    = 'v'
+	kindNotFound = 'n'
+)
+
+func (c *RedisCache) report(err error) {
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
+
+func (c *RedisCache) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), c.timeout)
+}
+
+func (c *RedisCache) redisKey(key interface{}) (string, error) {
+	s, err := c.codec.EncodeKey(key)
+	if err != nil {
+		return "", fmt.Errorf("rediscache: encoding key %v: %w", key, err)
+	}
+	return c.prefix + s, nil
+}
+
+func (c *RedisCache) Get(key interface{}) (dataloader.Value, bool) {
+	values, found := c.GetMany([]interface{}{key})
+	return values[0], found[0]
+}
+
+// GetMany gets the values of keys with a single MGET.
+func (c *RedisCache) GetMany(keys []interface{}) ([]dataloader.Value, []bool) {
+	values := make([]dataloader.Value, len(keys))
+	found := make([]bool, len(keys))
+	// The positions in keys of the Redis keys.
+	var rkeys []string
+	var positions []int
+	for i, key := range keys {
+		rkey, err := c.redisKey(key)
+		if err != nil {
+			c.report(err)
+			continue
+		}
+		rkeys = append(rkeys, rkey)
+		positions = append(positions, i)
+	}
+	if len(rkeys) == 0 {
+		return values, found
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	data, err := c.client.MGet(ctx, rkeys...)
+	if err != nil {
+		c.report(fmt.Errorf("rediscache: mget of %d keys: %w", len(rkeys), err))
+		return values, found
+	}
+	for j, d := range data {
+		if d == nil {
+			continue
+		}
+		v, err := c.decode(d)
+		if err != nil {
+			c.report(fmt.Errorf("rediscache: decoding %s: %w", rkeys[j], err))
+			continue
+		}
+		values[positions[j]], found[positions[j]] = v, true
+	}
+	return values, found
+}
+
+func (c *RedisCache) decode(data []byte) (dataloader.Value, error) {
+	if len(data) == 0 {
+		return dataloader.Value{}, errors.New("empty value")
+	}
+	switch data[0] {
+	case kindNotFound:
+		return dataloader.NotFound(), nil
+	case kindValue:
+		v, err := c.codec.DecodeValue(data[1:])
+		return dataloader.Value{V: v}, err
+	}
+	return dataloader.Value{}, fmt.Errorf("unknown kind %q", data[0])
+}
+
+// encode returns the data stored for v, or false if v isn't stored.
+func (c *RedisCache) encode(key interface{}, v dataloader.Value) ([]byte, bool) {
+	switch {
+	case v.Err == nil:
+		encoded, err := c.codec.EncodeValue(v.V)
+		if err != nil {
+			c.report(fmt.Errorf("rediscache: encoding value of %v: %w", key, err))
+			return nil, false
+		}
+		return append([]byte{kindValue}, encoded...), true
+	case errors.Is(v.Err, dataloader.ErrNotFound):
+		return []byte{kindNotFound}, true
+	}
+	return nil, false
+}
+
+func (c *RedisCache) Set(key interface{}, v dataloader.Value) {
+	c.SetMany([]interface{}{key}, []dataloader.Value{v})
+}
+
+// SetMany sets the values of keys with a single call to Client.SetMany.
+func (c *RedisCache) SetMany(keys []interface{}, values []dataloader.Value) {
+	var rkeys []string
+	var data [][]byte
+	for i, key := range keys {
+		d, ok := c.encode(key, values[i])
+		if !ok {
+			continue
+		}
+		rkey, err := c.redisKey(key)
+		if err != nil {
+			c.report(err)
+			continue
+		}
+		rkeys = append(rkeys, rkey)
+		data = append(data, d)
+	}
+	if len(rkeys) == 0 {
+		return
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.client.SetMany(ctx, rkeys, data, c.ttl); err != nil {
+		c.report(fmt.Errorf("rediscache: set of %d keys: %w", len(rkeys), err))
+	}
+}
+
+func (c *RedisCache) Delete(key interface{}) {
+	rkey, err := c.redisKey(key)
+	if err != nil {
+		c.report(err)
+		return
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	if err := c.client.Del(ctx, rkey); err != nil {
+		c.report(fmt.Errorf("rediscache: del %s: %w", rkey, err))
+	}
+}
+
+// scan calls f with the Redis keys under the prefix, some at a time, until f returns
+// false. Each SCAN command is bounded by the timeout.
+func (c *RedisCache) scan(f func(rkeys []string) bool) {
+	match := globEscape(c.prefix) + "*"
+	var cursor uint64
+	for {
+		ctx, cancel := c.context()
+		rkeys, next, err := c.client.Scan(ctx, cursor, match, scanCount)
+		cancel()
+		if err != nil {
+			c.report(fmt.Errorf("rediscache: scan %s: %w", match, err))
+			return
+		}
+		if len(rkeys) > 0 && !f(rkeys) {
+			return
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+// Clear removes all the values under the prefix, from all the processes.
+func (c *RedisCache) Clear() {
+	c.scan(func(rkeys []string) bool {
+		ctx, cancel := c.context()
+		defer cancel()
+		if err := c.client.Del(ctx, rkeys...); err != nil {
+			c.report(fmt.Errorf("rediscache: del: %w", err))
+		}
+		return true
+	})
+}
+
+// Len returns the number of values under the prefix, an estimate since SCAN may return
+// a key more than once. It scans all the keys, and is meant for occasional calls:
+// dataloader.Registry doesn't report it.
+func (c *RedisCache) Len() int {
+	n := 0
+	c.scan(func(rkeys []string) bool {
+		n += len(rkeys)
+		return true
+	})
+	return n
+}
+
+// Range calls f for each value under the prefix, skipping the ones expiring or failing
+// to decode meanwhile. The values are read with a MGET per SCAN.
+func (c *RedisCache) Range(f func(key interface{}, v dataloader.Value) bool) {
+	c.scan(func(rkeys []string) bool {
+		keys := make([]interface{}, 0, len(rkeys))
+		for _, rkey := range rkeys {
+			key, err := c.codec.DecodeKey(rkey[len(c.prefix):])
+			if err != nil {
+				c.report(fmt.Errorf("rediscache: decoding key %s: %w", rkey, err))
+				continue
+			}
+			keys = append(keys, key)
+		}
+		values, found := c.GetMany(keys)
+		for i, key := range keys {
+			if found[i] && !f(key, values[i]) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// globEscape escapes the special characters of Redis glob-style patterns.
+func globEscape(s string) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
@@ -0,0 +1,155 @@
+package rediscache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+	"github.com/bigdrum/godataloader/rediscache"
+)
+
+// fakeRedis is an in-memory Client.
+type fakeRedis struct {
+	mu    sync.Mutex
+	data  map[string][]byte
+	ttls  map[string]time.Duration
+	err   error
+	calls []string // The MGET and SET commands, with their number of keys.
+	order []string // The keys ever set, in order, for Scan.
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{data: make(map[string][]byte), ttls: make(map[string]time.Duration)}
+}
+
+func (r *fakeRedis) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, fmt.Sprint("mget ", len(keys)))
+	data := make([][]byte, len(keys))
+	for i, key := range keys {
+		data[i] = r.data[key]
+	}
+	return data, r.err
+}
+
+func (r *fakeRedis) SetMany(ctx context.Context, keys []string, data [][]byte, ttl time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, fmt.Sprint("set ", len(keys)))
+	for i, key := range keys {
+		if _, ok := r.ttls[key]; !ok {
+			r.order = append(r.order, key)
+		}
+		r.data[key] = data[i]
+		r.ttls[key] = ttl
+	}
+	return r.err
+}
+
+func (r *fakeRedis) Del(ctx context.Context, keys ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		delete(r.data, key)
+	}
+	return r.err
+}
+
+// Scan returns a single key at a time, the cursor being its position in order.
+func (r *fakeRedis) Scan(ctx context.Context, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ; int(cursor) < len(r.order); cursor++ {
+		key := r.order[cursor]
+		if _, ok := r.data[key]; !ok {
+			continue
+		}
+		if ok, _ := path.Match(match, key); !ok {
+			continue
+		}
+		next := cursor + 1
+		if int(next) == len(r.order) {
+			next = 0
+		}
+		return []string{key}, next, r.err
+	}
+	return nil, 0, r.err
+}
+
+func TestRedisCache(t *testing.T) {
+	redis := newFakeRedis()
+	var fetched []int
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			fetched = append(fetched, key.(int))
+			if key.(int) < 0 {
+				values[i] = dataloader.NotFound()
+				continue
+			}
+			values[i] = dataloader.NewValue(fmt.Sprint("user", key), nil)
+		}
+		return values
+	}
+	newLoader := func() *dataloader.DataLoader {
+		c := rediscache.New(redis, rediscache.JSONCodec[int, string]{}, rediscache.WithPrefix("users:"), rediscache.WithTTL(time.Minute))
+		return dataloader.New(nil, batchLoader, dataloader.WithCache(c))
+	}
+
+	// Two processes sharing the values.
+	first, second := newLoader(), newLoader()
+	first.LoadMany([]interface{}{1, -1})
+	values := second.LoadMany([]interface{}{1, -1, 2})
+	if values[0].V != "user1" || !errors.Is(values[1].Err, dataloader.ErrNotFound) || values[2].V != "user2" {
+		t.Error("unexpected values:", values)
+	}
+	sort.Ints(fetched)
+	if fmt.Sprint(fetched) != "[-1 1 2]" {
+		t.Error("expect the values loaded by the other loader to be shared, fetched:", fetched)
+	}
+	if redis.ttls["users:1"] != time.Minute {
+		t.Error("expect the values to expire, got", redis.ttls)
+	}
+	if fmt.Sprint(redis.calls) != "[mget 2 set 2 mget 3 set 1]" {
+		t.Error("expect a single command to read, and to write, the keys of each load, got", redis.calls)
+	}
+	registry := dataloader.NewRegistry()
+	registry.Register("users", first)
+	registry.Collect(func(s dataloader.Sample) {
+		if s.Name == "cache_entries" {
+			t.Error("expect the values of a remote cache not to be counted on each scrape")
+		}
+	})
+
+	var keys []interface{}
+	c := rediscache.New(redis, rediscache.JSONCodec[int, string]{}, rediscache.WithPrefix("users:"))
+	c.Range(func(key interface{}, v dataloader.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool { return keys[i].(int) < keys[j].(int) })
+	if fmt.Sprint(keys) != "[-1 1 2]" || c.Len() != 3 {
+		t.Error("unexpected keys:", keys)
+	}
+	c.Clear()
+	if len(redis.data) != 0 {
+		t.Error("expect the values cleared, got", redis.data)
+	}
+
+	var errs []error
+	redis.err = errors.New("connection refused")
+	fetched = nil
+	dl := dataloader.New(nil, batchLoader, dataloader.WithCache(rediscache.New(redis, rediscache.JSONCodec[int, string]{}, rediscache.WithOnError(func(err error) {
+		errs = append(errs, err)
+	}))))
+	if v := dl.Load(3); v.V != "user3" || len(fetched) != 1 || len(errs) == 0 {
+		t.Error("expect Redis errors to fall through to the batchLoader, got", v, errs)
+	}
+}
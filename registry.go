@@ -0,0 +1,153 @@
+package dataloader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry names a set of loaders, to observe them together.
+type Registry struct {
+	mu      sync.RWMutex
+	loaders map[string]*DataLoader
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{loaders: make(map[string]*DataLoader)}
+}
+
+// Register adds dl to the registry under name, replacing any loader with the same name.
+func (r *Registry) Register(name string, dl *DataLoader) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loaders[name] = dl
+}
+
+// Unregister removes the loader registered under name.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.loaders, name)
+}
+
+// Loader returns the loader registered under name, or nil if none.
+func (r *Registry) Loader(name string) *DataLoader {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.loaders[name]
+}
+
+// each calls f for each registered loader, ordered by name.
+func (r *Registry) each(f func(name string, dl *DataLoader)) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.loaders))
+	for name := range r.loaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	loaders := make([]*DataLoader, len(names))
+	for i, name := range names {
+		loaders[i] = r.loaders[name]
+	}
+	r.mu.RUnlock()
+	for i, name := range names {
+		f(name, loaders[i])
+	}
+}
+
+// MetricsHandler returns a handler rendering the metrics of the registered loaders in
+// the Prometheus text format, labelled by loader name.
+func (r *Registry) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.writeMetrics(w)
+	})
+}
+
+type metric struct {
+	name, help, typ string
+	value           func(dl *DataLoader) float64
+}
+
+var loaderMetrics = []metric{
+	{"cache_entries", "Number of values in the cache.", "gauge", func(dl *DataLoader) float64 {
+		return float64(dl.cache.Len())
+	}},
+	{"pending_keys", "Number of keys waiting for a fetch or being fetched.", "gauge", func(dl *DataLoader) float64 {
+		return float64(dl.pendingLen())
+	}},
+	{"cache_hits_total", "Number of keys loaded from the cache.", "counter", func(dl *DataLoader) float64 {
+		return float64(dl.Stats().Hits)
+	}},
+	{"cache_misses_total", "Number of keys loaded missing from the cache.", "counter", func(dl *DataLoader) float64 {
+		return float64(dl.Stats().Misses)
+	}},
+	{"keys_deduped_total", "Number of keys missing from the cache joining a fetch of the same key.", "counter", func(dl *DataLoader) float64 {
+		return float64(dl.Stats().Deduped)
+	}},
+	{"batch_calls_total", "Number of calls to the batch function.", "counter", func(dl *DataLoader) float64 {
+		return float64(dl.Stats().BatchCalls)
+	}},
+	{"keys_fetched_total", "Number of keys passed to the batch function.", "counter", func(dl *DataLoader) float64 {
+		return float64(dl.Stats().KeysFetched)
+	}},
+	{"primes_total", "Number of values primed into the cache.", "counter", func(dl *DataLoader) float64 {
+		return float64(dl.Stats().Primes)
+	}},
+}
+
+// Sample is the value of a metric of a registered loader, see Registry.Collect.
+type Sample struct {
+	// Name is the name of the metric without the "dataloader_" prefix, e.g.
+	// "cache_hits_total", and Type its Prometheus type, "counter" or "gauge".
+	Name, Help, Type string
+	Loader           string
+	Value            float64
+}
+
+// Collect calls f with the metrics of the registered loaders, those rendered by
+// MetricsHandler, ordered by metric then loader name. The cache_entries gauge isn't
+// reported for the loaders with a BatchCache.
+func (r *Registry) Collect(f func(s Sample)) {
+	for _, m := range loaderMetrics {
+		r.each(func(name string, dl *DataLoader) {
+			if m.name == "cache_entries" && dl.batchCache != nil {
+				// Counting the values of a BatchCache, e.g. a remote one, is too costly
+				// for each scrape, and they aren't the loader's own anyway.
+				return
+			}
+			f(Sample{Name: m.name, Help: m.help, Type: m.typ, Loader: name, Value: m.value(dl)})
+		})
+	}
+}
+
+// Describe calls f with each metric rendered by MetricsHandler, without loader nor
+// value, e.g. to describe them to a Prometheus registry before any loader registers.
+func (r *Registry) Describe(f func(s Sample)) {
+	for _, m := range loaderMetrics {
+		f(Sample{Name: m.name, Help: m.help, Type: m.typ})
+	}
+}
+
+func (r *Registry) writeMetrics(w io.Writer) {
+	last := ""
+	r.Collect(func(s Sample) {
+		if s.Name != last {
+			fmt.Fprintf(w, "# HELP dataloader_%s %s\n# TYPE dataloader_%s %s\n", s.Name, s.Help, s.Name, s.Type)
+			last = s.Name
+		}
+		fmt.Fprintf(w, "dataloader_%s{loader=\"%s\"} %v\n", s.Name, EscapeLabelValue(s.Loader), s.Value)
+	})
+}
+
+// EscapeLabelValue escapes v to be quoted as a label value in the Prometheus text
+// format.
+func EscapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,54 @@
+package dataloader_test
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestRegistryMetricsHandler(t *testing.T) {
+	echo := dataloader.Serial(func(key interface{}) dataloader.Value {
+		return dataloader.NewValue(key, nil)
+	})
+	users := dataloader.New(nil, echo)
+	users.LoadMany([]interface{}{1, 2, 3})
+	posts := dataloader.New(nil, echo)
+	posts.Load(1)
+
+	r := dataloader.NewRegistry()
+	r.Register("users", users)
+	r.Register(`po"sts`, posts)
+	r.Register("gone", posts)
+	r.Unregister("gone")
+
+	srv := httptest.NewServer(r.MetricsHandler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(body)
+	for _, line := range []string{
+		"# TYPE dataloader_cache_entries gauge",
+		`dataloader_cache_entries{loader="po\"sts"} 1`,
+		`dataloader_cache_entries{loader="users"} 3`,
+		`dataloader_pending_keys{loader="users"} 0`,
+		"# TYPE dataloader_batch_calls_total counter",
+		`dataloader_keys_fetched_total{loader="users"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expect %q in:\n%s", line, out)
+		}
+	}
+	if strings.Contains(out, "gone") {
+		t.Errorf("expect unregistered loaders to be skipped:\n%s", out)
+	}
+}
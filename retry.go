@@ -0,0 +1,75 @@
+package dataloader
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryAfterer is implemented by errors carrying a backend's hint of how long to wait
+// before trying again, e.g. from a Retry-After header when rate limited. A batchLoader
+// returns such an error in a Value to ask for the key to be retried no sooner than
+// that.
+type RetryAfterer interface {
+	RetryAfter() time.Duration
+}
+
+// RetryAfter returns the retry hint carried by err, or by any error it wraps.
+func RetryAfter(err error) (time.Duration, bool) {
+	var ra RetryAfterer
+	if !errors.As(err, &ra) {
+		return 0, false
+	}
+	return ra.RetryAfter(), true
+}
+
+// retry fetches again the keys whose value is an error, other than ErrNotFound, up to
+// dl.retries times, and replaces their values. Before each attempt, it waits for the
+// backoff, or the longest RetryAfter hint of the errors if longer, yielding to the
+// scheduler if any.
+func (dl *DataLoader) retry(ctx context.Context, keys []interface{}, values []Value) {
+	for attempt := 1; attempt <= dl.retries; attempt++ {
+		var failed []int
+		var delay time.Duration
+		for i, v := range values {
+			if v.Err == nil || errors.Is(v.Err, ErrNotFound) {
+				continue
+			}
+			failed = append(failed, i)
+			if d, ok := RetryAfter(v.Err); ok && d > delay {
+				delay = d
+			}
+		}
+		if len(failed) == 0 {
+			return
+		}
+		if dl.retryBackoff != nil {
+			if d := dl.retryBackoff(attempt); d > delay {
+				delay = d
+			}
+		}
+		if delay > 0 && dl.sleep(delay) != nil {
+			// The scheduler was cancelled.
+			return
+		}
+		retryKeys := make([]interface{}, len(failed))
+		for j, i := range failed {
+			retryKeys[j] = keys[i]
+		}
+		for j, v := range dl.loadChunks(ctx, retryKeys) {
+			values[failed[j]] = v
+		}
+	}
+}
+
+// sleep waits for d, yielding to the scheduler if any. It returns the error of the
+// scheduler context if done first.
+func (dl *DataLoader) sleep(d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	// The signal is never fired, the wait ends with ctx.
+	if err := newSignal(dl.sch).wait(ctx); err != ctx.Err() {
+		return err
+	}
+	return nil
+}
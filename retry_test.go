@@ -0,0 +1,89 @@
+package dataloader_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bigdrum/godataloader"
+)
+
+type rateLimitedError struct {
+	after time.Duration
+}
+
+func (e rateLimitedError) Error() string {
+	return "rate limited"
+}
+
+func (e rateLimitedError) RetryAfter() time.Duration {
+	return e.after
+}
+
+func TestRetryAfter(t *testing.T) {
+	err := fmt.Errorf("loading user: %w", rateLimitedError{after: time.Second})
+	if d, ok := dataloader.RetryAfter(err); !ok || d != time.Second {
+		t.Error("expect the hint of the wrapped error, got", d, ok)
+	}
+	if _, ok := dataloader.RetryAfter(errors.New("plain")); ok {
+		t.Error("expect no hint for a plain error")
+	}
+	if _, ok := dataloader.RetryAfter(nil); ok {
+		t.Error("expect no hint for nil")
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	var calls []string
+	var backoffs []int
+	batchLoader := func(keys []interface{}) []dataloader.Value {
+		calls = append(calls, fmt.Sprint(keys))
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			switch {
+			case key == "broken":
+				values[i].Err = errors.New("broken")
+			case key == "flaky" && len(calls) == 1:
+				values[i].Err = rateLimitedError{after: 5 * time.Millisecond}
+			case key == "flaky" && len(calls) == 2:
+				values[i].Err = errors.New("transient")
+			default:
+				values[i].V = key
+			}
+		}
+		return values
+	}
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+
+	var flaky, broken []dataloader.Value
+	start := time.Now()
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, batchLoader, dataloader.WithRetry(2, backoff))
+		sch.Spawn(func() {
+			flaky = append(flaky, dl.Load("flaky"))
+		})
+		sch.Spawn(func() {
+			flaky = append(flaky, dl.Load("flaky"))
+		})
+	})
+	if time.Since(start) < 5*time.Millisecond {
+		t.Error("expect the retry to wait for the RetryAfter hint")
+	}
+	if fmt.Sprint(flaky) != "[{flaky <nil>} {flaky <nil>}]" || len(calls) != 3 {
+		t.Errorf("expect the loads to share the retries, got %v, calls: %v", flaky, calls)
+	}
+
+	calls, backoffs = nil, nil
+	dl := dataloader.New(nil, batchLoader, dataloader.WithRetry(2, backoff))
+	broken = dl.LoadMany([]interface{}{"ok", "broken"})
+	if broken[0].V != "ok" || broken[1].Err == nil {
+		t.Error("expect the error once the retries are exhausted, got", broken)
+	}
+	if len(calls) != 3 || fmt.Sprint(calls[1:]) != "[[broken] [broken]]" || fmt.Sprint(backoffs) != "[1 2]" {
+		t.Errorf("expect only the failed key to be retried, calls: %v, backoffs: %v", calls, backoffs)
+	}
+}
@@ -0,0 +1,69 @@
+package dataloader
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// TypeRouter is a batchLoader for loaders whose keys are of several types, each type
+// being fetched by its own batch function. As all the keys share the loader's batch
+// window, a fetch cycle calls each registered function at most once.
+//
+// Register all the types before using the router, it is not safe to register
+// concurrently with loads.
+type TypeRouter struct {
+	loaders map[reflect.Type]func(keys []interface{}) []Value
+}
+
+// NewTypeRouter creates a router without any registered type.
+func NewTypeRouter() *TypeRouter {
+	return &TypeRouter{loaders: make(map[reflect.Type]func(keys []interface{}) []Value)}
+}
+
+// Register makes the router fetch keys having the same type as key with batchLoader.
+func (r *TypeRouter) Register(key interface{}, batchLoader func(keys []interface{}) []Value) {
+	r.loaders[reflect.TypeOf(key)] = batchLoader
+}
+
+// Load dispatches the keys to the batch functions of their types and merges the
+// results back in the order of keys. It is meant to be passed to New.
+func (r *TypeRouter) Load(keys []interface{}) []Value {
+	values := make([]Value, len(keys))
+	// Keys of each type along with their positions in keys, types are kept in order
+	// of first appearance so that the calls are deterministic.
+	var types []reflect.Type
+	byType := make(map[reflect.Type][]int)
+	for i, key := range keys {
+		t := reflect.TypeOf(key)
+		if _, ok := byType[t]; !ok {
+			types = append(types, t)
+		}
+		byType[t] = append(byType[t], i)
+	}
+	for _, t := range types {
+		indexes := byType[t]
+		batchLoader, ok := r.loaders[t]
+		if !ok {
+			err := fmt.Errorf("dataloader: no batch function registered for key type %v", t)
+			for _, i := range indexes {
+				values[i] = Value{Err: err}
+			}
+			continue
+		}
+		typedKeys := make([]interface{}, len(indexes))
+		for j, i := range indexes {
+			typedKeys[j] = keys[i]
+		}
+		// Like the loader does, the keys without a value get ErrMissingResult, and the
+		// extra values are ignored.
+		typedValues := batchLoader(typedKeys)
+		for j, i := range indexes {
+			if j < len(typedValues) {
+				values[i] = typedValues[j]
+			} else {
+				values[i] = Value{Err: ErrMissingResult}
+			}
+		}
+	}
+	return values
+}
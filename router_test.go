@@ -0,0 +1,76 @@
+package dataloader_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+type userID int
+type postID int
+
+func TestTypeRouter(t *testing.T) {
+	calls := map[string][]interface{}{}
+	router := dataloader.NewTypeRouter()
+	router.Register(userID(0), dataloader.Serial(func(key interface{}) dataloader.Value {
+		return dataloader.NewValue(fmt.Sprint("user", key), nil)
+	}))
+	router.Register(postID(0), func(keys []interface{}) []dataloader.Value {
+		calls["post"] = append(calls["post"], keys...)
+		values := make([]dataloader.Value, len(keys))
+		for i, key := range keys {
+			values[i] = dataloader.NewValue(fmt.Sprint("post", key), nil)
+		}
+		return values
+	})
+
+	var batches int
+	var user dataloader.Value
+	var others []dataloader.Value
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			batches++
+			return router.Load(keys)
+		})
+		sch.Spawn(func() {
+			user = dl.Load(userID(1))
+		})
+		sch.Spawn(func() {
+			others = dl.LoadMany([]interface{}{postID(1), postID(2), "other"})
+		})
+	})
+
+	if batches != 1 {
+		t.Error("expect one fetch cycle, got", batches)
+	}
+	if len(calls["post"]) != 2 {
+		t.Error("expect both posts fetched in a single call, got", calls["post"])
+	}
+	if user.V != "user1" {
+		t.Error("unexpected value:", user)
+	}
+	if fmt.Sprint(others) != "[{post1 <nil>} {post2 <nil>} {<nil> dataloader: no batch function registered for key type string}]" {
+		t.Error("unexpected values:", others)
+	}
+}
+
+func TestTypeRouterResultLength(t *testing.T) {
+	router := dataloader.NewTypeRouter()
+	// Short of a value for the last key.
+	router.Register(userID(0), func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys)-1)
+	})
+	// An extra value.
+	router.Register(postID(0), func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys)+1)
+	})
+	values := router.Load([]interface{}{userID(1), postID(1), userID(2)})
+	if len(values) != 3 || values[0].Err != nil || values[1].Err != nil {
+		t.Fatal("unexpected values:", values)
+	}
+	if !errors.Is(values[2].Err, dataloader.ErrMissingResult) {
+		t.Error("expect ErrMissingResult for the key without a value, got", values[2])
+	}
+}
@@ -1,52 +1,116 @@
 package dataloader
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 // Scheduler provides a custom way to run tasks (arbitrary functions) with a specific
-// execution order, with two priorities.
+// execution order, with priorities.
 //
 // Use "RunWithScheduler" to start a root task. This taskcan spawn new ones with
 // Spaw/SpawnLow with normal/low priorities respectively. All task managed by the
 // schedule must be spawned in this way. RunWithScheduler returns when all spawned tasks
 // finish.
 //
-// At a given time, one and only one single task is active in execution. Initially,
-// the root task is active. The scheduling (switching the active task) happens
-// when the current active task becomes inactive, i.e. it finishes, or blocked by
+// At a given time, one and only one single task is active in execution, unless the
+// scheduler has several slots, see WithSlots. Initially, the root task is
+// active. The scheduling (switching the active task) happens when the current active
+// task becomes inactive, i.e. it finishes, or blocked by
 // Notification.Wait Note that the normal blocking in Go, such as waiting for mutex, waitgroup,
 // channel etc doesn't trigger the scheduling here. Waiting for a mutex in a spawned
 // task to be unlocked by another one is likely to cause deadlock, so only use Notification.Wait
 // to coordinate the execution.
 //
 // The scheduler will not schedule tasks with low priority until all tasks with normal
-// priority are inactive. For tasks with the same priority, they are scheduled in a FILO
-// manner (And this is an arbitrary choice since a stack is easier to implement than a queue).
+// priority are inactive. More priority levels can be used with SpawnAt, see
+// WithPriorityLevels. For tasks with the same priority, they are scheduled in a FILO
+// manner by default (And this is an arbitrary choice since a stack is easier to implement
+// than a queue), see WithPolicy.
 //
 // This is a very simple scheduler, that provides just enough feature for dataloader: it
 // collects data request with normal priority, and fetch data in low priority, so as to ensure
 // more requests are collected before making the single batched call to remote service.
 //
 // It would be interesting to extend the scheduler to support features beyond that:
-// * Support "multi-slot", i.e. multiple task can be active at a given time.
-// * Support richer inter task communication feature, such as channel, select, mutex.
-// * Support pluggable scheduling algorithm.
-// * Use context.Context to pass around scheduler, opt-in.
+// * Support richer inter task communication feature, such as mutex (see Chan and Select).
 //
-// All functions must be called from the spawned tasks. It is not thread-safe to
-// call the functions from an "external" goroutine.
+// WithSchedulerContext ties the scheduler to a context: once it is done, the tasks
+// not started yet are dropped, and the waiting ones are woken up. A task panicking
+// stops the scheduler the same way, and the panic is raised again by RunWithScheduler
+// on the caller's goroutine once the tasks started finish.
+//
+// All functions must be called from the spawned tasks, except SpawnOn and Inbox.Close.
+// They are safe for concurrent use, as tasks run in parallel with several slots.
 //
 // Does it create new goroutines?
 //
-// Each time when the task is yield (Notification.Wait), a new goroutine is created. Spawn
-// doesn't create new goroutines. In theory, the new goroutine is not necessary. But
-// we use this approach to limit the stack size (probably not necessary, we should benchmark which
-// way is better.)
+// Each time when the task is yield (Notification.Wait), another goroutine goes on
+// scheduling, while the waiting one keeps the stack of the task. The goroutines which
+// resumed a task are kept idle for that, up to the number of slots, so a new goroutine
+// is only created when none is idle: about one per task waiting at the same time, rather
+// than one per Wait, see BenchmarkWaitGoroutines. Spawn doesn't create new goroutines.
 type Scheduler struct {
-	// They actually act as stacks.
-	normalQ []schedulable
-	lowQ    []schedulable
+	// mu guards the queues and the bookkeeping below. Tasks may run in parallel on
+	// several slots, and other goroutines may post tasks with SpawnOn.
+	mu sync.Mutex
+	// The runnable tasks by priority, the first being the normal one, and the last the
+	// low one. Ordered by posting time, the policy picks the next task to run.
+	queues [][]schedulable
+
+	// active counts the goroutines scheduling or running a task, at most slots. While
+	// it is lower, posting a task starts a new goroutine to run it. lowRunning counts
+	// the tasks of lower than normal priority started and not finished, nor waiting in
+	// Notification.Wait. They never run at the same time as normal priority ones, so
+	// that a task waiting has a lower priority whenever lowRunning is positive.
+	slots      int
+	active     int
+	lowRunning int
+
+	policy Policy
+	// tasks counts the spawned tasks not finished yet, and inboxes the open inboxes.
+	// done is closed when both drop to zero, or the former once cancelled.
+	tasks    int
+	inboxes  int
+	finished bool
+	done     chan struct{}
+
+	ctx       context.Context
+	cancelled bool
+	// err is the cause of the cancellation, the context error or the failure below,
+	// returned by Notification.wait from then on.
+	err error
+	// failure is the first panic of a task, or the deadlock detected, raised again by
+	// RunWithScheduler.
+	failure error
+
+	stats     SchedulerStats
+	queued    int // The number of tasks in the queues.
+	softCap   int
+	statsDest *SchedulerStats
+
+	// idle counts the goroutines parked after resuming a task, to take over the
+	// scheduling when a task waits, by receiving from handoff.
+	idle    int
+	handoff chan struct{}
+
+	detectDeadlock bool
+	// onTaskStart and onTaskEnd are the hooks set with WithTaskHook, called with the
+	// IDs assigned from lastTaskID. running is the ID of the task running, the only one
+	// with the hooks.
+	onTaskStart func(taskID uint64)
+	onTaskEnd   func(taskID uint64)
+	lastTaskID  uint64
+	running     uint64
+	// external counts the waiters which may be woken up from outside the tasks, by
+	// their context.
+	external int
+	// waiters are the tasks blocked in Notification.Wait, to wake up on cancellation.
+	waiters map[*waiter]struct{}
 }
 
 type schedulable struct {
@@ -54,57 +118,612 @@ type schedulable struct {
 	pickNext bool
 }
 
-// RunWithScheduler starts a root task and wait for it and its subtasks to finish.
-func RunWithScheduler(f func(sch *Scheduler)) {
-	sch := &Scheduler{}
+// RunWithScheduler starts a root task and wait for it and its subtasks to finish. If a
+// task panics, it panics with a *TaskPanicError once they finish, see also
+// WithDeadlockDetection.
+func RunWithScheduler(f func(sch *Scheduler), opts ...SchedulerOption) {
+	if err := newScheduler(opts).run(f); err != nil {
+		panic(err)
+	}
+}
+
+// RunWithSchedulerErr is like RunWithScheduler, for a root task that may fail: it
+// returns the error of f once all the tasks finish. If a task panics, it returns the
+// *TaskPanicError instead of panicking, and likewise for a deadlock detected.
+func RunWithSchedulerErr(f func(sch *Scheduler) error, opts ...SchedulerOption) error {
+	var err error
+	if panicErr := newScheduler(opts).run(func(sch *Scheduler) {
+		err = f(sch)
+	}); panicErr != nil {
+		return panicErr
+	}
+	return err
+}
+
+// SchedulerOption configures a Scheduler.
+type SchedulerOption func(*Scheduler)
+
+// WithFIFO makes the tasks of the same priority run in the order they were spawned,
+// instead of the last spawned first, like WithPolicy(FIFO). Both orders perform alike,
+// see BenchmarkScheduler.
+func WithFIFO() SchedulerOption {
+	return WithPolicy(FIFO)
+}
+
+// WithPolicy makes p pick the task to run next among the runnable ones of the same
+// priority, LIFO by default.
+func WithPolicy(p Policy) SchedulerOption {
+	return func(sch *Scheduler) {
+		sch.policy = p
+	}
+}
+
+// WithSlots makes up to n tasks active at a given time, running in parallel, rather
+// than one. The tasks must then synchronize the data they share, the Scheduler
+// functions are safe for concurrent use.
+//
+// Low priority tasks still only start when no normal priority one is runnable nor
+// running, so that the dataloader batches collect all the keys. Conversely, the normal
+// priority tasks runnable wait for the low priority ones running to finish or wait in
+// Notification.Wait, like with a single slot, but the latter run in parallel.
+func WithSlots(n int) SchedulerOption {
+	return func(sch *Scheduler) {
+		if n > 1 {
+			sch.slots = n
+		}
+	}
+}
+
+// WithSchedulerContext sets the context returned by sch.Context(), e.g. the one of an
+// incoming request.
+//
+// Once ctx is done, the scheduler stops: the tasks not started yet are dropped, and
+// spawning new ones is a no-op. The tasks blocked in Notification.Wait are woken up,
+// and Wait returns right away from then on, so they can check sch.Context().Err() and
+// wrap up. RunWithScheduler returns when the tasks already started finish.
+func WithSchedulerContext(ctx context.Context) SchedulerOption {
+	return func(sch *Scheduler) {
+		sch.ctx = ctx
+	}
+}
+
+// ErrSchedulerDeadlock is wrapped by the error raised by RunWithScheduler when the
+// scheduler detects a deadlock, see WithDeadlockDetection.
+var ErrSchedulerDeadlock = errors.New("dataloader: all tasks are waiting - deadlock")
+
+// WithDeadlockDetection makes the scheduler detect when all the tasks not finished are
+// waiting in Notification.Wait and none can notify them, like the Go runtime does for
+// goroutines. The scheduler then stops as if its context was done, and RunWithScheduler
+// panics with an error wrapping ErrSchedulerDeadlock once the tasks finish.
+//
+// The waits with a context that may be done, e.g. LoadCtx, are assumed to be woken up
+// by it eventually, and so are the waits while an Inbox is open, by the tasks posted to
+// it. Notifications from outside the tasks are not expected otherwise.
+func WithDeadlockDetection() SchedulerOption {
+	return func(sch *Scheduler) {
+		sch.detectDeadlock = true
+	}
+}
+
+// WithTaskHook makes the scheduler call onStart each time a task runs, when it starts
+// or resumes after Notification.Wait, and onEnd each time it stops, when it waits,
+// returns, or panics, e.g. to profile the tasks: the time between the calls is the
+// time the task ran. Either may be nil. Each spawned task, the root one included, gets
+// an ID, increasing in spawn order. Without hooks, tasks aren't numbered.
+//
+// The hooks need a single slot, to tell which task waits: the scheduler panics if
+// WithSlots is set too.
+func WithTaskHook(onStart, onEnd func(taskID uint64)) SchedulerOption {
+	return func(sch *Scheduler) {
+		sch.onTaskStart = onStart
+		sch.onTaskEnd = onEnd
+	}
+}
+
+// SchedulerStats are counters of a scheduler, to diagnose how tasks wait, see
+// Scheduler.Stats.
+type SchedulerStats struct {
+	// Switches counts the tasks started or resumed after Notification.Wait.
+	Switches uint64
+	// WaitGoroutines counts the goroutines started by Notification.Wait to go on
+	// scheduling while the task waits, when no idle one could be reused.
+	WaitGoroutines uint64
+	// MaxQueued is the largest number of tasks runnable at once, not started or resumed
+	// yet.
+	MaxQueued int
+}
+
+// WithSchedulerStats makes the scheduler copy its stats to s once the tasks finish,
+// for callers of RunWithScheduler which don't have the Scheduler anymore.
+func WithSchedulerStats(s *SchedulerStats) SchedulerOption {
+	return func(sch *Scheduler) {
+		sch.statsDest = s
+	}
+}
+
+// Stats returns the counters of the scheduler so far.
+func (sch *Scheduler) Stats() SchedulerStats {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	return sch.stats
+}
+
+// PendingNormal returns the number of normal priority tasks runnable, not started or
+// resumed yet, e.g. to apply backpressure when it grows, see also WithSoftQueueCap.
+func (sch *Scheduler) PendingNormal() int {
+	return sch.Pending(0)
+}
+
+// PendingLow returns the number of low priority tasks runnable, like PendingNormal.
+func (sch *Scheduler) PendingLow() int {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	return len(sch.queues[len(sch.queues)-1])
+}
+
+// Pending returns the number of tasks of the given priority runnable, like
+// PendingNormal, see SpawnAt.
+func (sch *Scheduler) Pending(priority int) int {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	return len(sch.queues[priority])
+}
+
+// WithSoftQueueCap sets the number of runnable tasks, of any priority, from which the
+// scheduler reports itself Overloaded. It doesn't limit the tasks spawned.
+func WithSoftQueueCap(n int) SchedulerOption {
+	return func(sch *Scheduler) {
+		sch.softCap = n
+	}
+}
+
+// Overloaded returns whether the runnable tasks reach the cap set by WithSoftQueueCap,
+// e.g. to reject new work. It is always false without a cap.
+func (sch *Scheduler) Overloaded() bool {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	return sch.softCap > 0 && sch.queued >= sch.softCap
+}
+
+// WithPriorityLevels sets the number of priority levels to n, 2 by default: tasks of
+// priority 0, the normal one, to n-1, the low one, see SpawnAt.
+func WithPriorityLevels(n int) SchedulerOption {
+	return func(sch *Scheduler) {
+		if n < 2 {
+			n = 2
+		}
+		sch.queues = make([][]schedulable, n)
+	}
+}
+
+func newScheduler(opts []SchedulerOption) *Scheduler {
+	sch := &Scheduler{
+		done:    make(chan struct{}),
+		queues:  make([][]schedulable, 2),
+		slots:   1,
+		policy:  LIFO,
+		ctx:     context.Background(),
+		waiters: make(map[*waiter]struct{}),
+	}
+	for _, opt := range opts {
+		opt(sch)
+	}
+	if sch.slots > 1 && (sch.onTaskStart != nil || sch.onTaskEnd != nil) {
+		panic("dataloader: WithTaskHook needs a single slot")
+	}
+	return sch
+}
+
+// TaskPanicError records a panic recovered from a task.
+type TaskPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *TaskPanicError) Error() string {
+	return fmt.Sprintf("dataloader: panic in task: %v", e.Value)
+}
+
+// Unwrap returns the recovered value if it is an error.
+func (e *TaskPanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// run runs f as the root task, and waits for all the tasks to finish. It returns the
+// first panic of a task, or the deadlock detected, if any.
+func (sch *Scheduler) run(f func(sch *Scheduler)) error {
+	ctx := sch.ctx
+	// The idle goroutines are at most as many as the slots, handing over never blocks.
+	sch.handoff = make(chan struct{}, sch.slots)
+	sch.active = 1 // This goroutine.
 	sch.Spawn(func() {
 		f(sch)
 	})
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sch.cancel(ctx.Err())
+			case <-sch.done:
+			}
+		}()
+	}
 	sch.schedule()
+	// The scheduling may have moved to other goroutines, which are still running.
+	<-sch.done
+	if sch.statsDest != nil {
+		*sch.statsDest = sch.Stats()
+	}
+	return sch.failure
 }
 
-func (sch *Scheduler) schedule() {
-	for {
-		q := &sch.normalQ
-		if len(*q) == 0 {
-			q = &sch.lowQ
-			if len(*q) == 0 {
-				return
+// Context returns the context of the scheduler, see WithSchedulerContext.
+func (sch *Scheduler) Context() context.Context {
+	return sch.ctx
+}
+
+// cancel drops the tasks not started yet, and wakes up the waiting ones with err.
+func (sch *Scheduler) cancel(err error) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sch.cancelLocked(err)
+}
+
+// failLocked records the failure of the scheduler, unless one was already, and stops
+// it.
+//
+// Must be called with sch.mu locked.
+func (sch *Scheduler) failLocked(err error) {
+	if sch.failure == nil {
+		sch.failure = err
+	}
+	sch.cancelLocked(err)
+}
+
+// Must be called with sch.mu locked.
+func (sch *Scheduler) cancelLocked(err error) {
+	if sch.cancelled {
+		return
+	}
+	sch.cancelled = true
+	sch.err = err
+	dropped := 0
+	drop := func(q []schedulable) []schedulable {
+		kept := q[:0]
+		for _, s := range q {
+			// Wake-ups resume tasks already started.
+			if s.pickNext {
+				dropped++
+				continue
 			}
+			kept = append(kept, s)
 		}
+		return kept
+	}
+	for p, q := range sch.queues {
+		sch.queues[p] = drop(q)
+	}
+	for w := range sch.waiters {
+		sch.wakeLocked(w, err)
+	}
+	sch.tasks -= dropped
+	sch.queued -= dropped
+	sch.finishLocked()
+}
+
+// finishLocked marks the scheduler finished once no task is left, nor may be posted.
+//
+// Must be called with sch.mu locked.
+func (sch *Scheduler) finishLocked() {
+	if sch.finished || sch.tasks > 0 || sch.inboxes > 0 && !sch.cancelled {
+		return
+	}
+	sch.finished = true
+	close(sch.done)
+}
 
-		newlen := len(*q) - 1
-		// LIFO.
-		s := (*q)[newlen]
-		*q = (*q)[:newlen]
+func (sch *Scheduler) schedule() {
+	for {
+		s, ok := sch.next()
+		if !ok {
+			return
+		}
 		s.action()
-		if !s.pickNext {
+		if !s.pickNext && !sch.park() {
 			return
 		}
 	}
 }
 
+// park keeps the goroutine idle after it resumed a task, which goes on with the slot,
+// until a task waits and hands the slot over. It returns false if there are enough idle
+// goroutines already, or once all the tasks finish.
+func (sch *Scheduler) park() bool {
+	sch.mu.Lock()
+	if sch.idle >= sch.slots || sch.finished {
+		sch.mu.Unlock()
+		return false
+	}
+	sch.idle++
+	sch.mu.Unlock()
+	select {
+	case <-sch.handoff:
+		return true
+	case <-sch.done:
+		return false
+	}
+}
+
+// next pops the next task to run. If there is none, the goroutine releases its slot,
+// until a task is posted.
+func (sch *Scheduler) next() (schedulable, bool) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	for p := range sch.queues {
+		q := &sch.queues[p]
+		if len(*q) == 0 {
+			continue
+		}
+		// Normal priority tasks wait for the lower priority ones running to finish or
+		// wait. The latter wait for the other active goroutines, besides this one, to
+		// run lower priority tasks too, as they may still run normal priority ones.
+		if p == 0 && sch.lowRunning > 0 || p > 0 && sch.active-1 > sch.lowRunning {
+			break
+		}
+		i := sch.policy.Pick(len(*q))
+		s := (*q)[i]
+		if i == 0 {
+			// Cheap for FIFO, the slice is reallocated as tasks are appended.
+			(*q)[0] = schedulable{}
+			*q = (*q)[1:]
+		} else {
+			*q = append((*q)[:i], (*q)[i+1:]...)
+		}
+		sch.queued--
+		sch.stats.Switches++
+		if p > 0 {
+			// Started or resumed.
+			sch.lowRunning++
+		}
+		if sch.queued > 0 {
+			// Other tasks can run on the free slots, e.g. the normal priority ones
+			// held back until now.
+			sch.startLocked()
+		}
+		return s, true
+	}
+	sch.active--
+	if sch.detectDeadlock && sch.active == 0 && len(sch.waiters) > 0 && sch.external == 0 && sch.inboxes == 0 {
+		// Nothing runs, nor will, to wake up the waiters.
+		sch.failLocked(fmt.Errorf("%w: %d tasks waiting", ErrSchedulerDeadlock, len(sch.waiters)))
+	}
+	return schedulable{}, false
+}
+
+// queuedLocked accounts for a task added to the queues.
+//
+// Must be called with sch.mu locked.
+func (sch *Scheduler) queuedLocked() {
+	sch.queued++
+	if sch.queued > sch.stats.MaxQueued {
+		sch.stats.MaxQueued = sch.queued
+	}
+}
+
+// startLocked starts a goroutine to run the posted tasks, if a slot is free.
+//
+// Must be called with sch.mu locked.
+func (sch *Scheduler) startLocked() {
+	if sch.active < sch.slots {
+		sch.active++
+		go sch.schedule()
+	}
+}
+
 // Spawn enqueue a task to be executed with normal priority.
 func (sch *Scheduler) Spawn(f func()) {
-	sch.spawnAt(&sch.normalQ, f)
+	sch.SpawnAt(0, f)
 }
 
 // SpawnLow enqueue a task to be executed with lower than normal priority.
 func (sch *Scheduler) SpawnLow(f func()) {
-	sch.spawnAt(&sch.lowQ, f)
+	sch.SpawnAt(len(sch.queues)-1, f)
 }
 
-func (sch *Scheduler) spawnAt(q *[]schedulable, f func()) {
-	*q = append(*q, schedulable{func() {
+// SpawnAt enqueue a task to be executed with the given priority, from 0, the normal
+// one, to the number of levels minus one, the low one, see WithPriorityLevels. The
+// tasks of a priority only run when the ones of higher priorities are inactive.
+func (sch *Scheduler) SpawnAt(priority int, f func()) {
+	if priority < 0 || priority >= len(sch.queues) {
+		panic(fmt.Sprintf("dataloader: priority %d out of range [0, %d)", priority, len(sch.queues)))
+	}
+	sch.spawnAt(priority, f)
+}
+
+// Inbox receives the tasks posted to a scheduler from other goroutines with SpawnOn,
+// e.g. to hand background work from a request scoped scheduler to a long-lived one.
+// While open, it keeps the scheduler running once its tasks finish, waiting for posts.
+type Inbox struct {
+	sch    *Scheduler
+	closed bool // Guarded by sch.mu.
+}
+
+// NewInbox opens an inbox on sch, to be closed once no more tasks are posted to it.
+func NewInbox(sch *Scheduler) *Inbox {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	if sch.finished {
+		panic("dataloader: inbox on a finished scheduler")
+	}
+	sch.inboxes++
+	return &Inbox{sch: sch}
+}
+
+// Close closes the inbox: the scheduler finishes once its tasks do, and SpawnOn fails
+// from then on. It may be called from any goroutine, more than once.
+func (in *Inbox) Close() {
+	sch := in.sch
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	if in.closed {
+		return
+	}
+	in.closed = true
+	sch.inboxes--
+	sch.finishLocked()
+}
+
+// SpawnOn enqueues a task to be executed with normal priority by the scheduler of in.
+// Unlike the other functions, it is safe to call from any goroutine, as the scheduler
+// typically runs on another one. It returns false, without running f, if the inbox is
+// closed or the scheduler stopped, see WithSchedulerContext.
+func SpawnOn(in *Inbox, f func()) bool {
+	sch := in.sch
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	if in.closed || sch.cancelled {
+		return false
+	}
+	sch.spawnLocked(0, f)
+	return true
+}
+
+func (sch *Scheduler) spawnAt(priority int, f func()) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sch.spawnLocked(priority, f)
+}
+
+// SpawnAfter spawns f with normal priority once n is notified, or right away if it is
+// already, without a task waiting for n meanwhile. n must belong to sch. Unlike a task
+// waiting for n, f doesn't hold RunWithScheduler back: if n isn't notified before the
+// other tasks finish, or the scheduler is cancelled, f never runs.
+func (sch *Scheduler) SpawnAfter(n *Notification, f func()) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	if n.notified {
+		sch.spawnLocked(0, f)
+		return
+	}
+	n.after = append(n.after, f)
+}
+
+// Must be called with sch.mu locked.
+func (sch *Scheduler) spawnLocked(priority int, f func()) {
+	if sch.finished {
+		panic("dataloader: spawn on a finished scheduler")
+	}
+	if sch.cancelled {
+		return
+	}
+	sch.tasks++
+	if sch.onTaskStart != nil || sch.onTaskEnd != nil {
+		sch.lastTaskID++
+		f = sch.withTaskHook(sch.lastTaskID, f)
+	}
+	sch.queues[priority] = append(sch.queues[priority], schedulable{func() {
+		defer sch.taskDone(priority > 0)
+		defer sch.recoverTask()
 		f()
 	}, true})
+	sch.queuedLocked()
+	sch.startLocked()
+}
+
+// withTaskHook wraps f to call the hooks set with WithTaskHook around it. The waits of
+// the task call them too, see wait.
+func (sch *Scheduler) withTaskHook(id uint64, f func()) func() {
+	return func() {
+		sch.taskRuns(id)
+		defer sch.taskStops(id)
+		f()
+	}
+}
+
+// taskRuns records that the task id runs, and calls the onStart hook.
+func (sch *Scheduler) taskRuns(id uint64) {
+	sch.mu.Lock()
+	sch.running = id
+	sch.mu.Unlock()
+	if sch.onTaskStart != nil {
+		sch.onTaskStart(id)
+	}
+}
+
+// taskStops calls the onEnd hook for the task id.
+func (sch *Scheduler) taskStops(id uint64) {
+	if sch.onTaskEnd != nil {
+		sch.onTaskEnd(id)
+	}
+}
+
+// recoverTask recovers the panic of a task, if any, and stops the scheduler, so that
+// the panic is raised again by RunWithScheduler rather than crashing the goroutine
+// the task happens to run on.
+func (sch *Scheduler) recoverTask() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err := &TaskPanicError{Value: r, Stack: debug.Stack()}
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	sch.failLocked(err)
+}
+
+func (sch *Scheduler) taskDone(low bool) {
+	sch.mu.Lock()
+	defer sch.mu.Unlock()
+	if low {
+		sch.lowRunning--
+	}
+	sch.tasks--
+	sch.finishLocked()
 }
 
+// Policy decides which task runs next, among the runnable ones of the same priority.
+// The scheduler still runs all the normal priority tasks before the low priority ones.
+type Policy interface {
+	// Pick returns the index of the task to run next, among n >= 1 runnable tasks
+	// ordered from the first posted to the last.
+	Pick(n int) int
+}
+
+var (
+	// LIFO runs the last posted task first. This is the default, and the cheapest.
+	LIFO Policy = lifo{}
+	// FIFO runs the tasks in the order they were posted.
+	FIFO Policy = fifo{}
+)
+
+type lifo struct{}
+
+func (lifo) Pick(n int) int { return n - 1 }
+
+type fifo struct{}
+
+func (fifo) Pick(n int) int { return 0 }
+
 // Notification provides a way to allow a task to wait for a event to happen.
 type Notification struct {
-	q        []*sync.WaitGroup
-	sch      *Scheduler
+	sch *Scheduler
+	// Guarded by sch.mu.
+	q        []*waiter
 	notified bool
+	after    []func() // Spawned once notified, see SpawnAfter.
+}
+
+// waiter is a task blocked in Notification.Wait.
+type waiter struct {
+	wg sync.WaitGroup
+	// Guarded by sch.mu. woken is set once a wake-up is posted, so that a waiter
+	// woken by a cancellation isn't woken again by Notify. err is the cancellation.
+	woken bool
+	err   error
+	// low is set if the task waiting has a lower than normal priority, to resume it as
+	// such, see lowRunning.
+	low bool
 }
 
 // NewNotification creates a new notification.
@@ -114,32 +733,171 @@ func NewNotification(sch *Scheduler) *Notification {
 
 // Notify wakes up other tasks that waited for the notification.
 func (n *Notification) Notify() {
+	n.sch.mu.Lock()
+	defer n.sch.mu.Unlock()
+	n.notifyLocked()
+}
+
+// Must be called with n.sch.mu locked.
+func (n *Notification) notifyLocked() {
 	n.notified = true
-	for i := range n.q {
-		wg := n.q[i]
-		n.sch.normalQ = append(n.sch.normalQ, schedulable{func() {
-			wg.Done()
-		}, false})
+	for _, w := range n.q {
+		n.sch.wakeLocked(w, nil)
+	}
+	n.q = nil
+	for _, f := range n.after {
+		if !n.sch.finished {
+			n.sch.spawnLocked(0, f)
+		}
 	}
+	n.after = nil
 }
 
-// Wait stops the current exeuction of the task, until notification is notified.
+// Reset makes the notification reusable after Notify, e.g. for a recurring event: Wait
+// blocks again until the next Notify. The tasks waiting already, if any, keep waiting
+// for it too.
+func (n *Notification) Reset() {
+	n.sch.mu.Lock()
+	defer n.sch.mu.Unlock()
+	n.notified = false
+}
+
+// Wait stops the current exeuction of the task, until notification is notified, or the
+// scheduler context is done.
 func (n *Notification) Wait() {
-	if n.notified {
+	n.wait(context.Background())
+}
+
+// WaitTimeout is like Wait, but gives up waiting after d. It returns whether the
+// notification was notified, rather than the wait timing out, or the scheduler context
+// being done.
+//
+// Like a notification, the timeout makes the task runnable again, and the task resumes
+// once the scheduler picks it: with a single slot, not before the running task yields,
+// so WaitTimeout may return well after d. The other tasks run meanwhile; the timer
+// doesn't hold a slot.
+func (n *Notification) WaitTimeout(d time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return n.wait(ctx) == nil
+}
+
+// wait is like Wait, but also wakes the task up if ctx is done first. It returns the
+// error of the context that woke the task up, if any.
+func (n *Notification) wait(ctx context.Context) error {
+	return n.sch.wait(ctx, n)
+}
+
+// wait stops the current task until one of ns is notified, or ctx or the scheduler
+// context is done. It returns the error of the context that woke the task up, if any.
+func (sch *Scheduler) wait(ctx context.Context, ns ...*Notification) error {
+	w := &waiter{}
+	w.wg.Add(1)
+	sch.mu.Lock()
+	for _, n := range ns {
+		if n.notified {
+			sch.mu.Unlock()
+			return nil
+		}
+	}
+	if sch.cancelled {
+		sch.mu.Unlock()
+		return sch.err
+	}
+	for _, n := range ns {
+		// Drop the waiters woken by another notification, e.g. the ones of a Select.
+		q := n.q[:0]
+		for _, other := range n.q {
+			if !other.woken {
+				q = append(q, other)
+			}
+		}
+		n.q = append(q, w)
+	}
+	sch.waiters[w] = struct{}{}
+	if ctx.Done() != nil {
+		sch.external++
+	}
+	if sch.lowRunning > 0 {
+		// Only lower priority tasks run, this one included, see next. It doesn't hold
+		// back the normal priority ones while waiting.
+		w.low = true
+		sch.lowRunning--
+	}
+	reuse := sch.idle > 0
+	if reuse {
+		sch.idle--
+	} else {
+		sch.stats.WaitGoroutines++
+	}
+	hooked := sch.onTaskStart != nil || sch.onTaskEnd != nil
+	task := sch.running
+	sch.mu.Unlock()
+	if hooked {
+		// Before the next task runs.
+		sch.taskStops(task)
+		defer sch.taskRuns(task)
+	}
+	if ctx.Done() != nil {
+		defer func() {
+			sch.mu.Lock()
+			defer sch.mu.Unlock()
+			sch.external--
+		}()
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				sch.mu.Lock()
+				defer sch.mu.Unlock()
+				sch.wakeLocked(w, ctx.Err())
+			case <-stop:
+			}
+		}()
+	}
+	if reuse {
+		sch.handoff <- struct{}{}
+	} else {
+		go sch.schedule()
+	}
+	w.wg.Wait()
+	return w.err
+}
+
+// wakeLocked posts the wake-up of w, unless already posted. The wake-up runs on the
+// goroutine scheduling, and doesn't pick the next task, as the woken task continues
+// on its own goroutine.
+//
+// Must be called with sch.mu locked.
+func (sch *Scheduler) wakeLocked(w *waiter, err error) {
+	if w.woken {
 		return
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	n.q = append(n.q, &wg)
-	go n.sch.schedule()
-	wg.Wait()
+	w.woken = true
+	w.err = err
+	delete(sch.waiters, w)
+	// Lower priority tasks resume ahead of the ones not started yet.
+	p := 0
+	if w.low {
+		p = 1
+	}
+	sch.queues[p] = append(sch.queues[p], schedulable{w.wg.Done, false})
+	sch.queuedLocked()
+	sch.startLocked()
 }
 
-// WaitGroup is like sync.WaitGroup but for scheduler.
+// WaitGroup is like sync.WaitGroup but for scheduler. Several tasks may wait for it, and
+// it can be reused once the counter drops to zero, after the Waits of the previous
+// round return. Like sync.WaitGroup, it panics when misused: when the counter goes
+// negative, or on reuse while a Wait of the previous round is still blocked, i.e. not
+// resumed yet.
 type WaitGroup struct {
-	// No lock is needed since Schduler is currently single threaded.
-	n         *Notification
+	n *Notification
+	// Guarded by n.sch.mu, as tasks may run in parallel. waiting counts the tasks
+	// blocked in Wait.
 	numToWait int
+	waiting   int
 }
 
 func NewWaitGroup(sch *Scheduler) *WaitGroup {
@@ -147,22 +905,38 @@ func NewWaitGroup(sch *Scheduler) *WaitGroup {
 }
 
 func (w *WaitGroup) Add(i int) {
+	w.n.sch.mu.Lock()
+	defer w.n.sch.mu.Unlock()
+	if w.numToWait+i < 0 {
+		panic("dataloader: negative WaitGroup counter")
+	}
+	if w.numToWait == 0 && i > 0 {
+		if w.waiting > 0 {
+			panic("dataloader: WaitGroup is reused before previous Wait has returned")
+		}
+		// Reused, the waiters of the previous round were all woken up.
+		w.n.notified = false
+	}
 	w.numToWait += i
+	if w.numToWait == 0 {
+		w.n.notifyLocked()
+	}
 }
 
 func (w *WaitGroup) Done() {
-	w.numToWait--
-	if w.numToWait < 0 {
-		panic("negative waitgroup")
-	}
-	if w.numToWait == 0 {
-		w.n.Notify()
-	}
+	w.Add(-1)
 }
 
 func (w *WaitGroup) Wait() {
+	w.n.sch.mu.Lock()
 	if w.numToWait == 0 {
+		w.n.sch.mu.Unlock()
 		return
 	}
+	w.waiting++
+	w.n.sch.mu.Unlock()
 	w.n.Wait()
+	w.n.sch.mu.Lock()
+	w.waiting--
+	w.n.sch.mu.Unlock()
 }
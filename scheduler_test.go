@@ -1,8 +1,15 @@
 package dataloader_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bigdrum/godataloader"
 )
@@ -49,10 +56,688 @@ func TestScheduler(t *testing.T) {
 
 func TestManySpawn(t *testing.T) {
 	// A test to avoid us doing recursion too much.
-	debug.SetMaxStack(4096)
+	defer debug.SetMaxStack(debug.SetMaxStack(4096))
 	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
 		for i := 0; i < 10000; i++ {
 			sch.Spawn(func() {})
 		}
 	})
 }
+
+func TestSpawnOn(t *testing.T) {
+	inboxes := make(chan *dataloader.Inbox)
+	var events []string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// A long-lived scheduler, with no task left but the inbox open.
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			inboxes <- dataloader.NewInbox(sch)
+		})
+		events = append(events, "finished")
+	}()
+
+	in := <-inboxes
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		done := make(chan struct{})
+		if !dataloader.SpawnOn(in, func() {
+			events = append(events, "transferred")
+			close(done)
+		}) {
+			t.Error("expect the task to be posted")
+		}
+		<-done
+	})
+	in.Close()
+	wg.Wait()
+	if fmt.Sprint(events) != "[transferred finished]" {
+		t.Error("unexpected events:", events)
+	}
+	if dataloader.SpawnOn(in, func() {}) {
+		t.Error("expect posting to a closed inbox to fail")
+	}
+
+	// An open inbox doesn't hold a stopped scheduler back.
+	ctx, cancel := context.WithCancel(context.Background())
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		in = dataloader.NewInbox(sch)
+		cancel()
+	}, dataloader.WithSchedulerContext(ctx))
+	if dataloader.SpawnOn(in, func() {}) {
+		t.Error("expect posting to a stopped scheduler to fail")
+	}
+}
+
+func TestSchedulerContext(t *testing.T) {
+	type key struct{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "v"))
+	defer cancel()
+	var fetches, ranLow, ranAfterCancel int
+	var loaded dataloader.Value
+	var waitReturned bool
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		if sch.Context().Value(key{}) != "v" {
+			t.Error("expect the context of the scheduler")
+		}
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			fetches++
+			return make([]dataloader.Value, len(keys))
+		})
+		sch.SpawnLow(func() {
+			ranLow++
+		})
+		started := dataloader.NewNotification(sch)
+		sch.Spawn(func() {
+			started.Notify()
+			loaded = dl.Load("a")
+			dataloader.NewNotification(sch).Wait()
+			waitReturned = true
+		})
+		started.Wait()
+
+		cancel()
+		// Let the scheduler see the cancellation, it runs no task in between.
+		time.Sleep(20 * time.Millisecond)
+		sch.Spawn(func() {
+			ranAfterCancel++
+		})
+	}, dataloader.WithSchedulerContext(ctx))
+	if ranLow != 0 || fetches != 0 || ranAfterCancel != 0 {
+		t.Errorf("expect no task to start after cancellation, low: %d, fetches: %d, after: %d", ranLow, fetches, ranAfterCancel)
+	}
+	if !errors.Is(loaded.Err, context.Canceled) {
+		t.Error("expect the waiting load to be cancelled, got:", loaded)
+	}
+	if !waitReturned {
+		t.Error("expect Wait to return once cancelled")
+	}
+}
+
+func TestTaskPanic(t *testing.T) {
+	var loaded dataloader.Value
+	var ranLow bool
+	var recovered interface{}
+	func() {
+		defer func() {
+			recovered = recover()
+		}()
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				return make([]dataloader.Value, len(keys))
+			})
+			sch.SpawnLow(func() {
+				ranLow = true
+			})
+			started := dataloader.NewNotification(sch)
+			sch.Spawn(func() {
+				// Panics on the goroutine resuming the task, before the fetch.
+				started.Wait()
+				panic("boom")
+			})
+			sch.Spawn(func() {
+				started.Notify()
+				loaded = dl.Load("a")
+			})
+		})
+	}()
+	pe, ok := recovered.(*dataloader.TaskPanicError)
+	if !ok || pe.Value != "boom" || len(pe.Stack) == 0 {
+		t.Fatal("expect the panic of the task to be raised again, got:", recovered)
+	}
+	if ranLow {
+		t.Error("expect the tasks not started to be dropped")
+	}
+	if !errors.Is(loaded.Err, pe) {
+		t.Error("expect the waiting load to be cancelled by the panic, got:", loaded)
+	}
+}
+
+func TestRunWithSchedulerErr(t *testing.T) {
+	errBad := errors.New("bad")
+	var ranSpawned bool
+	err := dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+		sch.Spawn(func() {
+			ranSpawned = true
+		})
+		return errBad
+	})
+	if err != errBad || !ranSpawned {
+		t.Errorf("expect the error of the root task once the tasks finish, got: %v, spawned ran: %v", err, ranSpawned)
+	}
+
+	if err := dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+		return nil
+	}); err != nil {
+		t.Error("expect no error, got:", err)
+	}
+
+	err = dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+		sch.Spawn(func() {
+			panic(errBad)
+		})
+		return nil
+	})
+	var pe *dataloader.TaskPanicError
+	if !errors.As(err, &pe) || !errors.Is(err, errBad) {
+		t.Error("expect the panic to be returned, got:", err)
+	}
+
+	// The options combine with any entry point.
+	ctx, cancel := context.WithCancel(context.Background())
+	err = dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+		cancel()
+		dataloader.NewNotification(sch).Wait()
+		return sch.Context().Err()
+	}, dataloader.WithSchedulerContext(ctx), dataloader.WithSlots(2), dataloader.WithFIFO())
+	if err != context.Canceled {
+		t.Error("expect the error of the cancelled root task, got:", err)
+	}
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	var woken int
+	err := dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+		n := dataloader.NewNotification(sch)
+		for i := 0; i < 2; i++ {
+			sch.Spawn(func() {
+				n.Wait()
+				woken++
+			})
+		}
+		return nil
+	}, dataloader.WithDeadlockDetection())
+	if !errors.Is(err, dataloader.ErrSchedulerDeadlock) || err.Error() != "dataloader: all tasks are waiting - deadlock: 2 tasks waiting" {
+		t.Error("expect a deadlock, got:", err)
+	}
+	if woken != 2 {
+		t.Error("expect the waiting tasks to be woken up, got", woken)
+	}
+
+	// Waiting for a timeout, or a retry backoff, isn't a deadlock.
+	err = dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		var calls int
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			calls++
+			values := make([]dataloader.Value, len(keys))
+			if calls == 1 {
+				values[0].Err = errors.New("transient")
+			}
+			return values
+		}, dataloader.WithRetry(1, func(int) time.Duration { return time.Millisecond }))
+		dl.Pause()
+		if v := dl.LoadCtx(ctx, "a"); !errors.Is(v.Err, context.DeadlineExceeded) {
+			t.Error("expect the load to time out, got", v)
+		}
+		dl.Resume()
+		if v := dl.Load("a"); v.Err != nil || calls != 2 {
+			t.Errorf("expect the load to be retried, got %v, calls: %d", v, calls)
+		}
+		return nil
+	}, dataloader.WithDeadlockDetection())
+	if err != nil {
+		t.Error("expect no deadlock, got:", err)
+	}
+}
+
+func TestSchedulerStats(t *testing.T) {
+	var stats dataloader.SchedulerStats
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		n := dataloader.NewNotification(sch)
+		for i := 0; i < 3; i++ {
+			sch.Spawn(n.Wait)
+		}
+		sch.SpawnLow(n.Notify)
+		if got := sch.Stats(); got.Switches != 1 || got.MaxQueued != 4 {
+			t.Errorf("expect the root task running with 4 tasks queued, got %+v", got)
+		}
+	}, dataloader.WithSchedulerStats(&stats))
+	// The root task, the 3 waiting ones, the notifying one, and the 3 resumed.
+	want := dataloader.SchedulerStats{Switches: 8, WaitGoroutines: 3, MaxQueued: 4}
+	if stats != want {
+		t.Errorf("expect %+v, got %+v", want, stats)
+	}
+}
+
+func TestSchedulerN(t *testing.T) {
+	// The tasks block each other outside of the scheduler, they must all be active.
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		var barrier sync.WaitGroup
+		barrier.Add(3)
+		for i := 0; i < 3; i++ {
+			sch.Spawn(func() {
+				barrier.Done()
+				barrier.Wait()
+			})
+		}
+	}, dataloader.WithSlots(3))
+
+	var mu sync.Mutex
+	var log []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		log = append(log, s)
+	}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		sch.SpawnLow(func() {
+			record("low")
+		})
+		// Leave the free slot a chance to run the low priority task too early.
+		time.Sleep(10 * time.Millisecond)
+		record("root")
+	}, dataloader.WithSlots(2))
+	if fmt.Sprint(log) != "[root low]" {
+		t.Error("expect low priority tasks to wait for the normal ones, got:", log)
+	}
+
+	// A low priority task waiting, like a fetch waiting for its batch window, doesn't
+	// let another one start alongside normal priority tasks.
+	log = nil
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		started := dataloader.NewNotification(sch)
+		window := dataloader.NewNotification(sch)
+		sch.SpawnLow(func() {
+			started.Notify()
+			window.Wait()
+		})
+		started.Wait()
+		sch.SpawnLow(func() {
+			record("low")
+		})
+		time.Sleep(10 * time.Millisecond)
+		record("root")
+		window.Notify()
+	}, dataloader.WithSlots(2))
+	if fmt.Sprint(log) != "[root low]" {
+		t.Error("expect low priority tasks to wait for the normal ones, got:", log)
+	}
+
+	// Conversely, a normal priority task woken up by a low priority one running waits for
+	// it to finish.
+	log = nil
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		fetched := dataloader.NewNotification(sch)
+		sch.SpawnLow(func() {
+			fetched.Notify()
+			time.Sleep(10 * time.Millisecond)
+			record("low")
+		})
+		fetched.Wait()
+		record("root")
+	}, dataloader.WithSlots(2))
+	if fmt.Sprint(log) != "[low root]" {
+		t.Error("expect normal priority tasks to wait for the low ones running, got:", log)
+	}
+
+	var batches [][]interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			batches = append(batches, keys)
+			return make([]dataloader.Value, len(keys))
+		})
+		for i := 0; i < 8; i++ {
+			i := i
+			sch.Spawn(func() {
+				dl.Load(i)
+			})
+		}
+	}, dataloader.WithSlots(4))
+	if len(batches) != 1 || len(batches[0]) != 8 {
+		t.Error("expect a single batch of all the keys, got:", batches)
+	}
+}
+
+// middleFirst is a Policy running the task in the middle of the queue first.
+type middleFirst struct{}
+
+func (middleFirst) Pick(n int) int { return n / 2 }
+
+func TestSchedulerPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy dataloader.Policy
+		want   string
+	}{
+		{dataloader.LIFO, "[2 1 0 low]"},
+		{dataloader.FIFO, "[0 1 2 low]"},
+		{middleFirst{}, "[1 2 0 low]"},
+	} {
+		var order []string
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			sch.SpawnLow(func() {
+				order = append(order, "low")
+			})
+			for i := 0; i < 3; i++ {
+				i := i
+				sch.Spawn(func() {
+					order = append(order, fmt.Sprint(i))
+				})
+			}
+		}, dataloader.WithPolicy(tc.policy))
+		if fmt.Sprint(order) != tc.want {
+			t.Errorf("%T: expect %s, got %v", tc.policy, tc.want, order)
+		}
+	}
+}
+
+func TestSpawnAt(t *testing.T) {
+	var order []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		sch.SpawnLow(func() {
+			order = append(order, "low")
+		})
+		sch.SpawnAt(1, func() {
+			order = append(order, "prefetch")
+			sch.Spawn(func() {
+				order = append(order, "normal from prefetch")
+			})
+		})
+		sch.Spawn(func() {
+			order = append(order, "normal")
+		})
+		defer func() {
+			if recover() == nil {
+				t.Error("expect a panic for an unknown priority")
+			}
+		}()
+		sch.SpawnAt(3, func() {})
+	}, dataloader.WithPriorityLevels(3))
+	if fmt.Sprint(order) != "[normal prefetch normal from prefetch low]" {
+		t.Error("expect the higher priorities to run first, got:", order)
+	}
+}
+
+func TestPendingQueues(t *testing.T) {
+	var normal, low []int
+	var overloaded []bool
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		for i := 0; i < 3; i++ {
+			sch.Spawn(func() {})
+		}
+		sch.SpawnLow(func() {
+			normal = append(normal, sch.PendingNormal())
+			low = append(low, sch.PendingLow())
+			overloaded = append(overloaded, sch.Overloaded())
+		})
+		sch.SpawnLow(func() {})
+		normal = append(normal, sch.PendingNormal())
+		low = append(low, sch.PendingLow())
+		overloaded = append(overloaded, sch.Overloaded())
+	}, dataloader.WithSoftQueueCap(5))
+	if fmt.Sprint(normal, low, overloaded) != "[3 0] [2 0] [true false]" {
+		t.Error("unexpected queue lengths:", normal, low, overloaded)
+	}
+}
+
+func TestTaskHook(t *testing.T) {
+	var events []string
+	hook := func(event string) func(taskID uint64) {
+		return func(taskID uint64) {
+			events = append(events, fmt.Sprint(event, taskID))
+		}
+	}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		n := dataloader.NewNotification(sch)
+		sch.Spawn(n.Notify)
+		sch.Spawn(n.Wait) // Runs first.
+	}, dataloader.WithTaskHook(hook("start"), hook("end")))
+	// The task waiting stops while the one notifying it runs.
+	if got := fmt.Sprint(events); got != "[start1 end1 start3 end3 start2 end2 start3 end3]" {
+		t.Error("unexpected events", got)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expect the hooks to need a single slot")
+			}
+		}()
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {}, dataloader.WithTaskHook(hook("start"), nil), dataloader.WithSlots(2))
+	}()
+
+	events = nil
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		sch.Spawn(func() {})
+	}, dataloader.WithTaskHook(nil, hook("end")))
+	if got := fmt.Sprint(events); got != "[end1 end2]" {
+		t.Error("unexpected events", got)
+	}
+}
+
+func TestSpawnAfter(t *testing.T) {
+	var events []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		n := dataloader.NewNotification(sch)
+		never := dataloader.NewNotification(sch)
+		sch.SpawnAfter(n, func() {
+			events = append(events, "after")
+			sch.SpawnAfter(n, func() {
+				events = append(events, "already notified")
+			})
+		})
+		sch.SpawnAfter(never, func() {
+			events = append(events, "never")
+		})
+		sch.Spawn(func() {
+			events = append(events, "notify")
+			n.Notify()
+		})
+	})
+	if fmt.Sprint(events) != "[notify after already notified]" {
+		t.Error("unexpected events:", events)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	var results []bool
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		n := dataloader.NewNotification(sch)
+		sch.Spawn(func() {
+			results = append(results, n.WaitTimeout(time.Hour))
+		})
+		sch.Spawn(func() {
+			results = append(results, dataloader.NewNotification(sch).WaitTimeout(time.Millisecond))
+			n.Notify()
+		})
+	}, dataloader.WithDeadlockDetection())
+	if fmt.Sprint(results) != "[false true]" {
+		t.Error("expect the timed out wait, then the notified one, got", results)
+	}
+}
+
+func TestWithFIFO(t *testing.T) {
+	var order []int
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		for i := 0; i < 3; i++ {
+			i := i
+			sch.Spawn(func() {
+				order = append(order, i)
+			})
+		}
+	}, dataloader.WithFIFO())
+	if fmt.Sprint(order) != "[0 1 2]" {
+		t.Error("expect the tasks to run in spawn order, got:", order)
+	}
+}
+
+func BenchmarkScheduler(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts []dataloader.SchedulerOption
+	}{
+		{"LIFO", nil},
+		{"FIFO", []dataloader.SchedulerOption{dataloader.WithFIFO()}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+					n := dataloader.NewNotification(sch)
+					for j := 0; j < 1000; j++ {
+						sch.Spawn(func() {
+							n.Wait()
+						})
+					}
+					sch.SpawnLow(n.Notify)
+				}, bc.opts...)
+			}
+		})
+	}
+}
+
+// BenchmarkWaitGoroutines has thousands of tasks each loading several times in a row,
+// reporting the goroutines started by Notification.Wait.
+func BenchmarkWaitGoroutines(b *testing.B) {
+	var started uint64
+	for i := 0; i < b.N; i++ {
+		var stats dataloader.SchedulerStats
+		dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+			dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+				return make([]dataloader.Value, len(keys))
+			})
+			for j := 0; j < 1000; j++ {
+				j := j
+				sch.Spawn(func() {
+					for k := 0; k < 5; k++ {
+						dl.Load(fmt.Sprint(j, k))
+					}
+				})
+			}
+		}, dataloader.WithSchedulerStats(&stats))
+		started += stats.WaitGoroutines
+	}
+	b.ReportMetric(float64(started)/float64(b.N), "goroutines/op")
+}
+
+func TestWaitGoroutinesReused(t *testing.T) {
+	const rounds = 1000
+	var stats dataloader.SchedulerStats
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		ping := dataloader.NewNotification(sch)
+		pong := dataloader.NewNotification(sch)
+		sch.Spawn(func() {
+			for i := 0; i < rounds; i++ {
+				ping.Notify()
+				pong.Wait()
+				pong.Reset()
+			}
+		})
+		sch.Spawn(func() {
+			for i := 0; i < rounds; i++ {
+				ping.Wait()
+				ping.Reset()
+				pong.Notify()
+			}
+		})
+	}, dataloader.WithSchedulerStats(&stats))
+	// The goroutines resuming the tasks are reused by the next waits, rather than
+	// started for each.
+	if stats.WaitGoroutines > 4 {
+		t.Errorf("expect a few goroutines started for %d round trips, got %d", rounds, stats.WaitGoroutines)
+	}
+}
+
+func TestNotificationReset(t *testing.T) {
+	var log []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		tick := dataloader.NewNotification(sch)
+		sch.Spawn(func() {
+			for i := 0; i < 3; i++ {
+				tick.Wait()
+				tick.Reset()
+				log = append(log, fmt.Sprint("tick ", i))
+			}
+		})
+		for i := 0; i < 3; i++ {
+			log = append(log, fmt.Sprint("notify ", i))
+			tick.Notify()
+			// Let the ticking task run.
+			done := dataloader.NewNotification(sch)
+			sch.SpawnLow(done.Notify)
+			done.Wait()
+		}
+	})
+	if fmt.Sprint(log) != "[notify 0 tick 0 notify 1 tick 1 notify 2 tick 2]" {
+		t.Error("expect a tick per notification, got:", log)
+	}
+}
+
+func TestWaitGroupMisuse(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		f    func(sch *dataloader.Scheduler, wg *dataloader.WaitGroup)
+		want string
+	}{
+		{"negative Done", func(sch *dataloader.Scheduler, wg *dataloader.WaitGroup) {
+			wg.Add(1)
+			wg.Done()
+			wg.Done()
+		}, "negative WaitGroup counter"},
+		{"negative Add", func(sch *dataloader.Scheduler, wg *dataloader.WaitGroup) {
+			wg.Add(-1)
+		}, "negative WaitGroup counter"},
+		{"reused before Wait returned", func(sch *dataloader.Scheduler, wg *dataloader.WaitGroup) {
+			wg.Add(1)
+			sch.Spawn(func() {
+				wg.Wait()
+			})
+			sch.SpawnLow(func() {
+				// The waiter is woken up, but doesn't run before this task.
+				wg.Done()
+				wg.Add(1)
+			})
+		}, "reused before previous Wait has returned"},
+	} {
+		err := dataloader.RunWithSchedulerErr(func(sch *dataloader.Scheduler) error {
+			tc.f(sch, dataloader.NewWaitGroup(sch))
+			return nil
+		})
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expect a panic with %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestWaitGroupReuse(t *testing.T) {
+	var log []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		wg := dataloader.NewWaitGroup(sch)
+		for round := 0; round < 2; round++ {
+			round := round
+			wg.Add(2)
+			for i := 0; i < 3; i++ {
+				i := i
+				sch.Spawn(func() {
+					wg.Wait()
+					log = append(log, fmt.Sprintf("round %d waiter %d", round, i))
+				})
+			}
+			for i := 0; i < 2; i++ {
+				sch.SpawnLow(func() {
+					log = append(log, fmt.Sprintf("round %d done", round))
+					wg.Done()
+				})
+			}
+			wg.Wait()
+			// Let the other waiters go before the next round.
+			done := dataloader.NewNotification(sch)
+			sch.SpawnLow(done.Notify)
+			done.Wait()
+		}
+	})
+	for round := 0; round < 2; round++ {
+		entries := append([]string(nil), log[round*5:round*5+5]...)
+		// The waiters go after both Done.
+		for _, e := range entries[:2] {
+			if e != fmt.Sprintf("round %d done", round) {
+				t.Errorf("expect the waiters of round %d to wait for Done, got: %v", round, log)
+			}
+		}
+		sort.Strings(entries)
+		want := fmt.Sprintf("[round %[1]d done round %[1]d done round %[1]d waiter 0 round %[1]d waiter 1 round %[1]d waiter 2]", round)
+		if fmt.Sprint(entries) != want {
+			t.Errorf("expect all the waiters of round %d to be woken up, got: %v", round, log)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package dataloader
+
+import (
+	"context"
+)
+
+// SelectCase is a case of Select, see Chan.RecvCase, Notification.Case and
+// SelectDefault.
+type SelectCase interface {
+	// try proceeds with the case if it is ready. Otherwise, it returns the notification
+	// to wait for before trying again.
+	try() (ready bool, changed *Notification)
+}
+
+// Select is like the select statement for the tasks of a Scheduler: it waits until one
+// of cases is ready, yielding meanwhile like Notification.Wait, then proceeds with it
+// and returns its index. When several cases are ready, the first one wins.
+//
+// With a SelectDefault case, Select doesn't wait: it returns the index of the default
+// case if no other one is ready. It returns -1 if the scheduler context is done.
+func Select(cases ...SelectCase) int {
+	def := -1
+	var sch *Scheduler
+	changed := make([]*Notification, 0, len(cases))
+	for {
+		changed = changed[:0]
+		for i, c := range cases {
+			if _, ok := c.(defaultCase); ok {
+				def = i
+				continue
+			}
+			ready, n := c.try()
+			if ready {
+				return i
+			}
+			sch = n.sch
+			changed = append(changed, n)
+		}
+		if def >= 0 || sch == nil {
+			return def
+		}
+		if err := sch.wait(context.Background(), changed...); err != nil {
+			return -1
+		}
+	}
+}
+
+type defaultCase struct{}
+
+func (defaultCase) try() (bool, *Notification) {
+	return false, nil
+}
+
+// SelectDefault returns a case chosen by Select when no other one is ready.
+func SelectDefault() SelectCase {
+	return defaultCase{}
+}
+
+// Case returns a case of Select, ready once n is notified.
+func (n *Notification) Case() SelectCase {
+	return notificationCase{n}
+}
+
+type notificationCase struct {
+	n *Notification
+}
+
+func (c notificationCase) try() (bool, *Notification) {
+	c.n.sch.mu.Lock()
+	defer c.n.sch.mu.Unlock()
+	return c.n.notified, c.n
+}
+
+// RecvCase returns a case of Select, ready when Recv wouldn't wait. Select then
+// receives the value, and calls f with it, if not nil.
+func (c *Chan[T]) RecvCase(f func(v T, ok bool)) SelectCase {
+	return &recvCase[T]{c: c, f: f}
+}
+
+type recvCase[T any] struct {
+	c *Chan[T]
+	f func(v T, ok bool)
+}
+
+func (rc *recvCase[T]) try() (bool, *Notification) {
+	c := rc.c
+	c.mu.Lock()
+	v, ok := c.tryRecvLocked()
+	closed := c.closed
+	changed := c.changed
+	c.mu.Unlock()
+	if !ok && !closed {
+		return false, changed
+	}
+	if rc.f != nil {
+		rc.f(v, ok)
+	}
+	return true, nil
+}
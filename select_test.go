@@ -0,0 +1,44 @@
+package dataloader_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+func TestSelect(t *testing.T) {
+	var log []string
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		ints := dataloader.NewChan[int](sch, 0)
+		strs := dataloader.NewChan[string](sch, 1)
+		quit := dataloader.NewNotification(sch)
+		sch.Spawn(func() {
+			ints.Send(1)
+			strs.Send("a")
+			ints.Send(2)
+			quit.Notify()
+		})
+
+		recvInt := ints.RecvCase(func(v int, ok bool) {
+			log = append(log, fmt.Sprint("int ", v))
+		})
+		recvStr := strs.RecvCase(func(v string, ok bool) {
+			log = append(log, "str "+v)
+		})
+		if i := dataloader.Select(recvInt, recvStr, dataloader.SelectDefault()); i != 2 {
+			t.Error("expect the default case when nothing is ready, got", i)
+		}
+		// When both channels are ready, ints wins as it comes first.
+		for {
+			i := dataloader.Select(recvInt, recvStr, quit.Case())
+			if i == 2 {
+				log = append(log, "quit")
+				break
+			}
+		}
+	})
+	if fmt.Sprint(log) != "[int 1 int 2 str a quit]" {
+		t.Error("unexpected log:", log)
+	}
+}
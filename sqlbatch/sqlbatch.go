@@ -0,0 +1,103 @@
+// Package sqlbatch builds batchLoaders running a single SQL query per batch, kept out of
+// the core package so that it doesn't depend on database/sql.
+package sqlbatch
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/bigdrum/godataloader"
+)
+
+// Queryer is the part of *sql.DB, *sql.Conn or *sql.Tx used to run the query.
+type Queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ScanFunc scans the current row, and returns the key it belongs to with its value. The
+// key must equal the loaded one, or its MapKey() for the keys implementing
+// dataloader.MapKeyer: e.g. an int64 column doesn't match int keys.
+type ScanFunc func(rows *sql.Rows) (key interface{}, v interface{}, err error)
+
+// Option configures a batchLoader.
+type Option func(*config)
+
+type config struct {
+	args func(keys []interface{}) []interface{}
+}
+
+// WithArgs sets the arguments of the query for the keys of a batch. By default, the
+// keys are passed as a single argument, e.g. for "WHERE id = ANY($1)": the driver must
+// accept a []interface{}, otherwise WithArgs converts it, e.g. with pq.Array.
+func WithArgs(args func(keys []interface{}) []interface{}) Option {
+	return func(c *config) {
+		c.args = args
+	}
+}
+
+// Batch returns a batchLoader running query on db once per batch, for dataloader.New.
+// The keys without a row get dataloader.ErrMissingResult. If a key has several rows,
+// the last one wins. An error running the query or scanning a row is returned for all
+// the keys of the batch.
+func Batch(db Queryer, query string, scan ScanFunc, opts ...Option) func(keys []interface{}) []dataloader.Value {
+	batch := BatchCtx(db, query, scan, opts...)
+	return func(keys []interface{}) []dataloader.Value {
+		return batch(context.Background(), keys)
+	}
+}
+
+// BatchCtx is like Batch, running the query with the context of the batch, for
+// dataloader.NewCtx.
+func BatchCtx(db Queryer, query string, scan ScanFunc, opts ...Option) func(ctx context.Context, keys []interface{}) []dataloader.Value {
+	c := config{
+		args: func(keys []interface{}) []interface{} {
+			return []interface{}{keys}
+		},
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return func(ctx context.Context, keys []interface{}) []dataloader.Value {
+		values := make([]dataloader.Value, len(keys))
+		found, err := queryRows(ctx, db, query, c.args(keys), scan)
+		for i, key := range keys {
+			switch v, ok := found[mapKey(key)]; {
+			case err != nil:
+				values[i].Err = err
+			case !ok:
+				values[i].Err = dataloader.ErrMissingResult
+			default:
+				values[i].V = v
+			}
+		}
+		return values
+	}
+}
+
+func queryRows(ctx context.Context, db Queryer, query string, args []interface{}, scan ScanFunc) (map[interface{}]interface{}, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlbatch: query: %w", err)
+	}
+	defer rows.Close()
+	found := make(map[interface{}]interface{})
+	for rows.Next() {
+		key, v, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqlbatch: scan: %w", err)
+		}
+		found[key] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlbatch: query: %w", err)
+	}
+	return found, nil
+}
+
+func mapKey(key interface{}) interface{} {
+	if k, ok := key.(dataloader.MapKeyer); ok {
+		return k.MapKey()
+	}
+	return key
+}
@@ -0,0 +1,117 @@
+package sqlbatch_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+	"github.com/bigdrum/godataloader/sqlbatch"
+)
+
+// fakeDriver serves the users table for "SELECT id, name FROM users WHERE id = ANY($1)",
+// ignoring the query text but recording it.
+type fakeDriver struct {
+	users   map[int64]string
+	queries []string
+	err     error
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c fakeConn) CheckNamedValue(v *driver.NamedValue) error {
+	return nil
+}
+
+func (c fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.queries = append(c.d.queries, fmt.Sprint(query, args[0].Value))
+	if c.d.err != nil {
+		return nil, c.d.err
+	}
+	rows := &fakeRows{}
+	for _, id := range args[0].Value.([]interface{}) {
+		if name, ok := c.d.users[id.(int64)]; ok {
+			rows.rows = append(rows.rows, []driver.Value{id, name})
+		}
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"id", "name"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func scanUser(rows *sql.Rows) (interface{}, interface{}, error) {
+	var id int64
+	var name string
+	err := rows.Scan(&id, &name)
+	return id, name, err
+}
+
+func TestBatch(t *testing.T) {
+	d := &fakeDriver{users: map[int64]string{1: "alice", 2: "bob"}}
+	sql.Register("sqlbatch-fake", d)
+	db, err := sql.Open("sqlbatch-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	query := "SELECT id, name FROM users WHERE id = ANY($1)"
+	dl := dataloader.New(nil, sqlbatch.Batch(db, query, scanUser))
+	values := dl.LoadMany([]interface{}{int64(2), int64(3), int64(1)})
+	if values[0].V != "bob" || values[1].Err != dataloader.ErrMissingResult || values[2].V != "alice" {
+		t.Error("expect the rows aligned with the keys, got", values)
+	}
+	if len(d.queries) != 1 {
+		t.Error("expect a single query, got", d.queries)
+	}
+
+	d.err = errors.New("connection lost")
+	dl = dataloader.New(nil, sqlbatch.Batch(db, query, scanUser, sqlbatch.WithArgs(func(keys []interface{}) []interface{} {
+		return []interface{}{keys, "extra"}
+	})))
+	values = dl.LoadMany([]interface{}{int64(1), int64(2)})
+	if !errors.Is(values[0].Err, d.err) || !errors.Is(values[1].Err, d.err) {
+		t.Error("expect the query error for all the keys, got", values)
+	}
+}
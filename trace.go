@@ -0,0 +1,31 @@
+package dataloader
+
+import "context"
+
+// Tracer starts the spans of a loader, see WithTracer. It is small enough to be adapted
+// to any tracing library, e.g. OpenTelemetry.
+type Tracer interface {
+	// Start starts a span named name, child of the span carried by ctx if any, and
+	// returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	End()
+}
+
+// startSpan starts a span with the tracer of dl, or a no-op one without tracer, in
+// which case ctx is returned as is.
+func (dl *DataLoader) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if dl.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return dl.tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) End()                                       {}
@@ -0,0 +1,80 @@
+package dataloader_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+type traceKey struct{}
+
+// recordingTracer records the ended spans, with the trace value of their parent
+// context.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+}
+
+type recordingSpan struct {
+	t     *recordingTracer
+	name  string
+	attrs []string
+}
+
+// Start makes the span the trace value of the returned context.
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, dataloader.Span) {
+	return context.WithValue(ctx, traceKey{}, name), &recordingSpan{t: t, name: fmt.Sprintf("%s(%v)", name, ctx.Value(traceKey{}))}
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) {
+	s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+}
+
+func (s *recordingSpan) End() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	sort.Strings(s.attrs)
+	s.t.spans = append(s.t.spans, fmt.Sprint(s.name, s.attrs))
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &recordingTracer{}
+	ctx := context.WithValue(context.Background(), traceKey{}, "request")
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.New(sch, func(keys []interface{}) []dataloader.Value {
+			return make([]dataloader.Value, len(keys))
+		}, dataloader.WithTracer(tracer))
+		dl.Prime("cached", dataloader.Value{})
+		sch.Spawn(func() {
+			dl.LoadManyCtx(context.WithValue(ctx, traceKey{}, "field"), []interface{}{"a", "b"})
+		})
+		dl.LoadMany([]interface{}{"a", "cached"})
+	}, dataloader.WithSchedulerContext(ctx))
+	want := "[dataloader.batch(request)[dataloader.batch_size=2 dataloader.cache_hits=0] dataloader.load(field)[dataloader.keys=2]]"
+	if fmt.Sprint(tracer.spans) != want {
+		t.Errorf("expect %s, got %v", want, tracer.spans)
+	}
+
+	// The batchLoader runs in the batch span.
+	var parent interface{}
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		dl := dataloader.NewCtx(sch, func(ctx context.Context, keys []interface{}) []dataloader.Value {
+			parent = ctx.Value(traceKey{})
+			return make([]dataloader.Value, len(keys))
+		}, dataloader.WithTracer(tracer))
+		dl.Load("a")
+	}, dataloader.WithSchedulerContext(ctx))
+	if parent != "dataloader.batch" {
+		t.Error("expect the batchLoader context to carry the batch span, got", parent)
+	}
+
+	// Without a tracer, the spans are no-ops.
+	dl := dataloader.New(nil, func(keys []interface{}) []dataloader.Value {
+		return make([]dataloader.Value, len(keys))
+	})
+	dl.LoadCtx(ctx, "a")
+}
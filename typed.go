@@ -0,0 +1,70 @@
+package dataloader
+
+// TypedValue wraps the value and error of a TypedLoader.
+type TypedValue[V any] struct {
+	V   V
+	Err error
+}
+
+// TypedLoader is a DataLoader with typed keys and values, so that callers don't have
+// to type-assert the loaded values. It is built on a DataLoader and shares its
+// batching, caching and scheduling.
+type TypedLoader[K comparable, V any] struct {
+	dl *DataLoader
+}
+
+// NewTyped creates a new typed dataloader, see New.
+func NewTyped[K comparable, V any](sch *Scheduler, batchLoader func(keys []K) []TypedValue[V], opts ...Option) *TypedLoader[K, V] {
+	return &TypedLoader[K, V]{dl: New(sch, func(keys []interface{}) []Value {
+		typedKeys := make([]K, len(keys))
+		for i, key := range keys {
+			typedKeys[i] = key.(K)
+		}
+		typedValues := batchLoader(typedKeys)
+		values := make([]Value, len(typedValues))
+		for i, v := range typedValues {
+			values[i] = Value{V: v.V, Err: v.Err}
+		}
+		return values
+	}, opts...)}
+}
+
+// DataLoader returns the underlying untyped loader.
+func (l *TypedLoader[K, V]) DataLoader() *DataLoader {
+	return l.dl
+}
+
+// Load loads a single value.
+func (l *TypedLoader[K, V]) Load(key K) (V, error) {
+	return unboxTyped[V](l.dl.Load(key))
+}
+
+// LoadMany loads multiple values, errs[i] being the error loading keys[i].
+func (l *TypedLoader[K, V]) LoadMany(keys []K) (values []V, errs []error) {
+	ikeys := make([]interface{}, len(keys))
+	for i, key := range keys {
+		ikeys[i] = key
+	}
+	ivalues := l.dl.LoadMany(ikeys)
+	values = make([]V, len(ivalues))
+	errs = make([]error, len(ivalues))
+	for i, v := range ivalues {
+		values[i], errs[i] = unboxTyped[V](v)
+	}
+	return values, errs
+}
+
+// Prime put a single value into the cache. No-op if the value already exists.
+func (l *TypedLoader[K, V]) Prime(key K, v V) {
+	l.dl.Prime(key, Value{V: v})
+}
+
+// Clear removes a single value from the cache.
+func (l *TypedLoader[K, V]) Clear(key K) {
+	l.dl.Clear(key)
+}
+
+func unboxTyped[V any](v Value) (V, error) {
+	typed, _ := v.V.(V)
+	return typed, v.Err
+}
@@ -0,0 +1,51 @@
+package dataloader_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bigdrum/godataloader"
+)
+
+type user struct {
+	id   int
+	name string
+}
+
+func TestTypedLoader(t *testing.T) {
+	var batches [][]int
+	dataloader.RunWithScheduler(func(sch *dataloader.Scheduler) {
+		users := dataloader.NewTyped[int, *user](sch, func(ids []int) []dataloader.TypedValue[*user] {
+			batches = append(batches, ids)
+			values := make([]dataloader.TypedValue[*user], len(ids))
+			for i, id := range ids {
+				if id < 0 {
+					values[i].Err = errors.New("invalid id")
+					continue
+				}
+				values[i].V = &user{id, fmt.Sprint("user", id)}
+			}
+			return values
+		})
+		users.Prime(0, &user{0, "root"})
+		sch.Spawn(func() {
+			u, err := users.Load(1)
+			if err != nil || u.name != "user1" {
+				t.Error("unexpected value:", u, err)
+			}
+		})
+		sch.Spawn(func() {
+			us, errs := users.LoadMany([]int{0, 2, -1})
+			if us[0].name != "root" || us[1].name != "user2" || us[2] != nil {
+				t.Error("unexpected values:", us)
+			}
+			if errs[0] != nil || errs[1] != nil || errs[2] == nil {
+				t.Error("unexpected errors:", errs)
+			}
+		})
+	})
+	if len(batches) != 1 || len(batches[0]) != 3 {
+		t.Error("expect a single batch of 3 keys, got", batches)
+	}
+}